@@ -37,6 +37,9 @@ var (
 	oauth2BearerRegex = regexp.MustCompile(`^[0-9a-zA-Z_+/]{33,}$`)
 )
 
+// Returned by WebhookAuth if the token used to create the webhook has expired.
+var ErrWebhookTokenExpired = errors.New("The authentication token used to create this webhook has expired")
+
 const (
 	USER_UNCONFIRMED       = "unconfirmed"
 	USER_ACTIVE_NON_PAYING = "active_non_paying"
@@ -636,7 +639,7 @@ func WebhookAuth(ctx context.Context, auth *AuthContext,
 	tokenHash [64]byte, grants string, clientID *string,
 	expires time.Time) (context.Context, error) {
 	if time.Now().UTC().After(expires) {
-		return nil, fmt.Errorf("The authentication token used to create this webhook has expired")
+		return nil, ErrWebhookTokenExpired
 	}
 
 	whAuth := *auth
@@ -652,6 +655,28 @@ func WebhookAuth(ctx context.Context, auth *AuthContext,
 	return context.WithValue(ctx, userCtxKey, &whAuth), nil
 }
 
+// Returns an auth context configured for delivery of a webhook which was
+// created with internal authentication. The "auth" parameter should be the
+// authentication context of the user who owns the webhook subscription, which
+// is not necessarily the user who caused the webhook to be fired, and the
+// client and node IDs are those of the internal client which created the
+// webhook. Internal authentication is not limited by grants, so the query
+// must be checked to be read-only before it is executed.
+func InternalWebhookAuth(ctx context.Context, auth *AuthContext,
+	clientID, nodeID string) context.Context {
+	whAuth := *auth
+	whAuth.AuthMethod = AUTH_INTERNAL
+	whAuth.InternalAuth = InternalAuth{
+		Name:     auth.Username,
+		ClientID: clientID,
+		NodeID:   nodeID,
+	}
+	whAuth.BearerToken = nil
+	whAuth.Grants = Grants{}
+	whAuth.TokenHash = [64]byte{}
+	return context.WithValue(ctx, userCtxKey, &whAuth)
+}
+
 func Middleware(conf ini.File, apiconf string) func(http.Handler) http.Handler {
 	var internalNet []*net.IPNet
 	src, ok := conf.Get(apiconf, "internal-ipnet")
@@ -672,7 +697,9 @@ func Middleware(conf ini.File, apiconf string) func(http.Handler) http.Handler {
 			if !strings.HasPrefix(r.URL.Path, "/query") ||
 				r.URL.Path == "/query/metrics" ||
 				r.URL.Path == "/query/api-meta.json" ||
-				strings.HasPrefix(r.URL.Path, "/query/external/") {
+				strings.HasPrefix(r.URL.Path, "/query/external/") ||
+				// Followed from email clients, which have no credentials
+				strings.HasPrefix(r.URL.Path, "/query/unsubscribe/") {
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -725,6 +752,12 @@ func Middleware(conf ini.File, apiconf string) func(http.Handler) http.Handler {
 	}
 }
 
+// Returns a context which is authenticated as the given user, for work which
+// is done on their behalf outside of a request.
+func Context(ctx context.Context, user *AuthContext) context.Context {
+	return context.WithValue(ctx, userCtxKey, user)
+}
+
 func ForContext(ctx context.Context) *AuthContext {
 	raw, ok := ctx.Value(userCtxKey).(*AuthContext)
 	if !ok {
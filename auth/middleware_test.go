@@ -150,6 +150,30 @@ func TestInternal(t *testing.T) {
 	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
 }
 
+func TestInternalWebhookAuth(t *testing.T) {
+	user := &AuthContext{
+		AuthMethod: AUTH_OAUTH2,
+		UserID:     1337,
+		Username:   "jdoe",
+		BearerToken: &BearerToken{
+			ClientID: "example",
+		},
+	}
+	ctx := InternalWebhookAuth(context.Background(), user,
+		"git.sr.ht", "us-east-3.git.sr.ht")
+
+	auth := ForContext(ctx)
+	assert.Equal(t, AUTH_INTERNAL, auth.AuthMethod)
+	assert.Equal(t, 1337, auth.UserID)
+	assert.Equal(t, "jdoe", auth.InternalAuth.Name)
+	assert.Equal(t, "git.sr.ht", auth.InternalAuth.ClientID)
+	assert.Equal(t, "us-east-3.git.sr.ht", auth.InternalAuth.NodeID)
+	assert.Nil(t, auth.BearerToken)
+
+	// The original auth context is unmodified
+	assert.Equal(t, AUTH_OAUTH2, user.AuthMethod)
+}
+
 var conf ini.File
 
 func init() {
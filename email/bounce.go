@@ -0,0 +1,178 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-message/textproto"
+	"github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+)
+
+// If [mail]bounce-address is set, e.g. to bounces@example.org, messages are
+// sent with a VERP-style envelope sender which encodes the recipient, such as
+// bounces+rms=example.org@example.org, so that bounces can be attributed to
+// the recipient even if the bounce message is not a well-formed DSN. Each
+// recipient receives a separate copy of the message in this case.
+//
+// See VERPRecipient and ParseDSN for processing bounces.
+
+var deliveryFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "email_delivery_failures",
+	Help: "The total number of emails which could not be delivered",
+}, []string{"permanent"})
+
+// Describes an email which could not be delivered.
+type DeliveryFailure struct {
+	MessageID  string
+	Recipients []string
+	Err        error
+	Attempts   int
+	// True if the message was rejected outright, e.g. because the recipient
+	// does not exist, and false if the delivery was abandoned after too many
+	// transient errors.
+	Permanent bool
+}
+
+// A recipient which was rejected by the server.
+type RecipientError struct {
+	Recipient string
+	Err       error
+}
+
+// Returned by Send when the server permanently rejected some of the
+// recipients. The message was still delivered to the other recipients.
+type RejectedRecipients []RecipientError
+
+func (r RejectedRecipients) Error() string {
+	var errs []string
+	for _, rerr := range r {
+		errs = append(errs, fmt.Sprintf("%s: %v", rerr.Recipient, rerr.Err))
+	}
+	return "recipients rejected: " + strings.Join(errs, "; ")
+}
+
+// Registers a function which is called for each email which could not be
+// delivered, e.g. to flag the recipient's address as undeliverable. This must
+// be called before the queue is started.
+func (queue *Queue) OnFailure(fn func(ctx context.Context, failure *DeliveryFailure)) {
+	queue.onFailure = fn
+}
+
+// Returns true if the error is a permanent delivery failure, i.e. a 5xx SMTP
+// reply, for which re-attempting delivery will not help.
+func IsPermanent(err error) bool {
+	var serr *smtp.SMTPError
+	if errors.As(err, &serr) {
+		return serr.Code >= 500 && serr.Code <= 599
+	}
+	var eerr *exec.ExitError
+	if errors.As(err, &eerr) {
+		// sendmail exit statuses, per sysexits.h
+		switch eerr.ExitCode() {
+		case 64, // EX_USAGE
+			65, // EX_DATAERR
+			67, // EX_NOUSER
+			68: // EX_NOHOST
+			return true
+		}
+	}
+	return false
+}
+
+func reportFailure(ctx context.Context, msg []byte, rcpts []string,
+	err error, attempts int, permanent bool) {
+	deliveryFailures.WithLabelValues(strconv.FormatBool(permanent)).Inc()
+
+	queue, ok := ctx.Value(emailCtxKey).(*Queue)
+	if !ok {
+		return
+	}
+	if permanent && queue.suppression {
+		for _, rcpt := range rcpts {
+			if err := Suppress(ctx, rcpt, "", SuppressBounce); err != nil {
+				log.Printf("Unable to suppress %s: %v", rcpt, err)
+			}
+		}
+	}
+	if queue.onFailure == nil {
+		return
+	}
+	failure := &DeliveryFailure{
+		Recipients: rcpts,
+		Err:        err,
+		Attempts:   attempts,
+		Permanent:  permanent,
+	}
+	header, herr := textproto.ReadHeader(bufio.NewReader(bytes.NewReader(msg)))
+	if herr == nil {
+		failure.MessageID = strings.Trim(header.Get("Message-Id"), "<> ")
+	} else {
+		log.Printf("Unable to read header of undeliverable mail: %v", herr)
+	}
+	queue.onFailure(ctx, failure)
+}
+
+// Returns the configured bounce address, or an empty string if VERP is not
+// enabled.
+func bounceAddress(conf ini.File) string {
+	bounce, ok := conf.Get("mail", "bounce-address")
+	if !ok {
+		return ""
+	}
+	addr, err := mail.ParseAddress(bounce)
+	if err != nil || !strings.Contains(addr.Address, "@") {
+		panic(fmt.Errorf("Unable to parse [mail]bounce-address (must be an email address)"))
+	}
+	return addr.Address
+}
+
+// Returns the envelope sender for a message to the given recipients.
+func envelopeSender(conf ini.File, rcpts []string) string {
+	bounce := bounceAddress(conf)
+	if bounce == "" || len(rcpts) != 1 {
+		return mustSender(conf)
+	}
+	return encodeVERP(bounce, rcpts[0])
+}
+
+func encodeVERP(bounce, rcpt string) string {
+	i := strings.LastIndexByte(bounce, '@')
+	return bounce[:i] + "+" + strings.Replace(rcpt, "@", "=", 1) + bounce[i:]
+}
+
+// Returns the original recipient encoded in a VERP address, such as the
+// recipient address of a bounce message, or false if the address is not a
+// VERP address for the configured bounce address.
+func VERPRecipient(ctx context.Context, address string) (string, bool) {
+	bounce := bounceAddress(config.ForContext(ctx))
+	if bounce == "" {
+		return "", false
+	}
+	i := strings.LastIndexByte(bounce, '@')
+	prefix, domain := bounce[:i]+"+", bounce[i:]
+
+	j := strings.LastIndexByte(address, '@')
+	if j == -1 || !strings.EqualFold(address[j:], domain) ||
+		!strings.HasPrefix(address[:j], prefix) {
+		return "", false
+	}
+	rcpt := address[len(prefix):j]
+	k := strings.LastIndexByte(rcpt, '=')
+	if k <= 0 || k == len(rcpt)-1 {
+		return "", false
+	}
+	return rcpt[:k] + "@" + rcpt[k+1:], true
+}
@@ -0,0 +1,133 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+
+	work "git.sr.ht/~sircmpwn/dowork"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsPermanent(t *testing.T) {
+	assert.True(t, IsPermanent(&smtp.SMTPError{Code: 550}))
+	assert.True(t, IsPermanent(fmt.Errorf("wrapped: %w",
+		&smtp.SMTPError{Code: 554})))
+	assert.False(t, IsPermanent(&smtp.SMTPError{Code: 451}))
+	assert.False(t, IsPermanent(&smtp.SMTPError{Code: 421}))
+	assert.False(t, IsPermanent(errors.New("connection refused")))
+
+	err := exec.Command("sh", "-c", "exit 67").Run()
+	assert.True(t, IsPermanent(err))
+	err = exec.Command("sh", "-c", "exit 75").Run()
+	assert.False(t, IsPermanent(err))
+}
+
+func TestVERP(t *testing.T) {
+	ctx := transportContext("bounce-address=Bounces <bounces@sr.ht>")
+	assert.Equal(t, "bounces+rms=example.org@sr.ht",
+		encodeVERP("bounces@sr.ht", "rms@example.org"))
+
+	for _, tc := range []struct {
+		address string
+		rcpt    string
+		ok      bool
+	}{
+		{"bounces+rms=example.org@sr.ht", "rms@example.org", true},
+		{"bounces+rms+lists=example.org@SR.HT", "rms+lists@example.org", true},
+		{"bounces@sr.ht", "", false},
+		{"bounces+rms@sr.ht", "", false},
+		{"bounces+rms=example.org@example.org", "", false},
+		{"other+rms=example.org@sr.ht", "", false},
+	} {
+		rcpt, ok := VERPRecipient(ctx, tc.address)
+		assert.Equal(t, tc.ok, ok, tc.address)
+		assert.Equal(t, tc.rcpt, rcpt, tc.address)
+	}
+
+	_, ok := VERPRecipient(transportContext(""), "bounces+rms=example.org@sr.ht")
+	assert.False(t, ok)
+}
+
+func TestVERPSender(t *testing.T) {
+	ctx, be := testServer(t, "bounce-address=bounces@example.org")
+
+	var header mail.Header
+	header.SetSubject("Hello")
+	header.SetAddressList("To", []*mail.Address{
+		{Address: "rms@example.org"},
+		{Address: "jdoe@example.org"},
+	})
+	assert.Nil(t, EnqueueStd(ctx, header, strings.NewReader("Hello!"), nil))
+	ForContext(ctx).Queue.Dispatch(ctx)
+
+	assert.Equal(t, []string{
+		"bounces+rms=example.org@example.org",
+		"bounces+jdoe=example.org@example.org",
+	}, be.senders)
+	assert.Len(t, be.messages, 2)
+}
+
+func TestDeliveryFailures(t *testing.T) {
+	ctx, be := testServer(t, "")
+	var failures []*DeliveryFailure
+	ForContext(ctx).OnFailure(func(ctx context.Context, failure *DeliveryFailure) {
+		failures = append(failures, failure)
+	})
+
+	var header mail.Header
+	header.SetMessageID("test@example.org")
+	header.SetSubject("Hello")
+	header.SetAddressList("To", []*mail.Address{{Address: "unknown@example.org"}})
+	assert.Nil(t, EnqueueStd(ctx, header, strings.NewReader("Hello!"), nil))
+	ForContext(ctx).Queue.Dispatch(ctx)
+
+	// Permanent failures are reported right away and not re-attempted
+	if assert.Len(t, failures, 1) {
+		assert.Equal(t, "test@example.org", failures[0].MessageID)
+		assert.Equal(t, []string{"unknown@example.org"}, failures[0].Recipients)
+		assert.True(t, failures[0].Permanent)
+		assert.Equal(t, 1, failures[0].Attempts)
+		assert.True(t, IsPermanent(failures[0].Err))
+	}
+
+	// Transient failures are reported once the retries are exhausted
+	failures = nil
+	task := NewTask(bytes.NewBufferString("Subject: Hello\r\n\r\nHello!"),
+		[]string{"busy@example.org"}).Retries(2)
+	for i := 0; i < 2; i++ {
+		_, err := task.Attempt(ctx)
+		assert.NotNil(t, err)
+		assert.False(t, errors.Is(err, work.ErrDoNotReattempt))
+		assert.Len(t, failures, 0)
+	}
+	_, err := task.Attempt(ctx)
+	assert.Equal(t, work.ErrMaxRetriesExceeded, err)
+	if assert.Len(t, failures, 1) {
+		assert.False(t, failures[0].Permanent)
+		assert.Equal(t, 2, failures[0].Attempts)
+		assert.False(t, IsPermanent(failures[0].Err))
+	}
+	assert.Len(t, be.messages, 0)
+
+	// Rejected recipients are reported individually, and the message is
+	// delivered to the others
+	failures = nil
+	task = NewTask(bytes.NewBufferString("Subject: Hello\r\n\r\nHello!"),
+		[]string{"unknown@example.org", "jdoe@example.org", "unknown@example.com"})
+	_, err = task.Attempt(ctx)
+	assert.Nil(t, err)
+	if assert.Len(t, failures, 2) {
+		assert.Equal(t, []string{"unknown@example.org"}, failures[0].Recipients)
+		assert.Equal(t, []string{"unknown@example.com"}, failures[1].Recipients)
+		assert.True(t, failures[0].Permanent)
+		assert.True(t, IsPermanent(failures[0].Err))
+	}
+	assert.Len(t, be.messages, 1)
+}
@@ -0,0 +1,74 @@
+package email
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/vaughan0/go-ini"
+)
+
+// Outgoing mail is signed with DKIM if the following options are set:
+//
+//	[mail]
+//	dkim-domain      - the signing domain, e.g. example.org
+//	dkim-selector    - the selector of the DNS record for the public key
+//	dkim-private-key - path to the PEM-encoded RSA or ed25519 private key
+//
+// Messages are signed after any S/MIME signing or encryption, as the last
+// step before they are queued.
+var dkimHeaderKeys = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id",
+	"In-Reply-To", "References", "MIME-Version", "Content-Type",
+	"Content-Transfer-Encoding", "Content-Disposition", "List-Id",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// Loads the configured DKIM options, or returns nil if DKIM signing is not
+// configured.
+func loadDKIMOptions(conf ini.File) *dkim.SignOptions {
+	keyPath, ok := conf.Get("mail", "dkim-private-key")
+	if !ok {
+		return nil
+	}
+	domain, ok := conf.Get("mail", "dkim-domain")
+	if !ok {
+		panic(fmt.Errorf("Missing DKIM configuration options [dkim-domain]"))
+	}
+	selector, ok := conf.Get("mail", "dkim-selector")
+	if !ok {
+		panic(fmt.Errorf("Missing DKIM configuration options [dkim-selector]"))
+	}
+
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read [mail]dkim-private-key: %v", err))
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse [mail]dkim-private-key: %v", err))
+	}
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		panic(fmt.Errorf("Unable to use [mail]dkim-private-key: ECDSA keys are not supported"))
+	}
+
+	return &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               selector,
+		Signer:                 key,
+		HeaderCanonicalization: dkim.CanonicalizationRelaxed,
+		BodyCanonicalization:   dkim.CanonicalizationRelaxed,
+		HeaderKeys:             dkimHeaderKeys,
+	}
+}
+
+// Returns a copy of the message with a DKIM-Signature header.
+func signDKIM(msg *bytes.Buffer, options *dkim.SignOptions) (*bytes.Buffer, error) {
+	var signed bytes.Buffer
+	if err := dkim.Sign(&signed, bytes.NewReader(msg.Bytes()), options); err != nil {
+		return nil, err
+	}
+	return &signed, nil
+}
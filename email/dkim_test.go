@@ -0,0 +1,102 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+)
+
+func TestDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, tc := range []struct {
+		keyType string
+		key     crypto.Signer
+		block   *pem.Block
+	}{
+		{"rsa", rsaKey, &pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(rsaKey),
+		}},
+		{"ed25519", edKey, nil},
+	} {
+		if tc.block == nil {
+			der, err := x509.MarshalPKCS8PrivateKey(tc.key)
+			if err != nil {
+				panic(err)
+			}
+			tc.block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		}
+
+		dir := t.TempDir()
+		keyPath := filepath.Join(dir, "dkim.pem")
+		if err := os.WriteFile(keyPath, pem.EncodeToMemory(tc.block), 0600); err != nil {
+			panic(err)
+		}
+		maildir := filepath.Join(dir, "maildir")
+		ctx := transportContext(fmt.Sprintf(`transport=maildir
+maildir=%s
+dkim-domain=example.org
+dkim-selector=test
+dkim-private-key=%s`, maildir, keyPath))
+
+		var header mail.Header
+		header.SetSubject("Hello")
+		header.SetAddressList("To", []*mail.Address{{Address: "rms@example.org"}})
+		assert.Nil(t, EnqueueStd(ctx, header,
+			strings.NewReader("Hello world!\n"), nil))
+		ForContext(ctx).Queue.Dispatch(ctx)
+
+		msgs := emailtest.Maildir(t, maildir)
+		if len(msgs) != 1 {
+			t.Fatalf("Expected one message, got %d", len(msgs))
+		}
+		msg := []byte(msgs[0])
+
+		der, err := x509.MarshalPKIXPublicKey(tc.key.Public())
+		if err != nil {
+			panic(err)
+		}
+		if tc.keyType == "ed25519" {
+			der = tc.key.Public().(ed25519.PublicKey)
+		}
+		record := fmt.Sprintf("v=DKIM1; k=%s; p=%s",
+			tc.keyType, base64.StdEncoding.EncodeToString(der))
+
+		verifications, err := dkim.VerifyWithOptions(bytes.NewReader(msg),
+			&dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					assert.Equal(t, "test._domainkey.example.org", domain)
+					return []string{record}, nil
+				},
+			})
+		assert.Nil(t, err, tc.keyType)
+		if assert.Len(t, verifications, 1, tc.keyType) {
+			assert.Nil(t, verifications[0].Err, tc.keyType)
+			assert.Equal(t, "example.org", verifications[0].Domain)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package email
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/textproto"
+)
+
+// A delivery status notification (RFC 3464), i.e. a bounce message.
+type DSN struct {
+	ReportingMTA string
+	// The Message-ID of the original message, if the DSN includes its header
+	MessageID  string
+	Recipients []DSNRecipient
+}
+
+// The delivery status of one recipient of the original message.
+type DSNRecipient struct {
+	// The recipient address, as given to the reporting MTA
+	FinalRecipient string
+	// The recipient address, as given by the sender, if known
+	OriginalRecipient string
+	// One of "failed", "delayed", "delivered", "relayed", or "expanded"
+	Action string
+	// The status code, e.g. "5.1.1"
+	Status string
+	// The remote MTA's reply, e.g. "550 5.1.1 No such user"
+	DiagnosticCode string
+}
+
+// Returns true if delivery to this recipient failed permanently, i.e. the
+// address should be considered undeliverable.
+func (rcpt *DSNRecipient) Permanent() bool {
+	return strings.EqualFold(rcpt.Action, "failed") &&
+		strings.HasPrefix(rcpt.Status, "5")
+}
+
+// Returns the addresses for which delivery failed permanently.
+func (dsn *DSN) Failed() []string {
+	var failed []string
+	for _, rcpt := range dsn.Recipients {
+		if !rcpt.Permanent() {
+			continue
+		}
+		if rcpt.OriginalRecipient != "" {
+			failed = append(failed, rcpt.OriginalRecipient)
+		} else {
+			failed = append(failed, rcpt.FinalRecipient)
+		}
+	}
+	return failed
+}
+
+// Parses an incoming delivery status notification, which is a
+// multipart/report message with a message/delivery-status part. An error is
+// returned if the message is not a DSN.
+func ParseDSN(r io.Reader) (*DSN, error) {
+	entity, err := message.Read(r)
+	if err != nil && !message.IsUnknownCharset(err) {
+		return nil, err
+	}
+	contentType, params, err := entity.Header.ContentType()
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "multipart/report" ||
+		!strings.EqualFold(params["report-type"], "delivery-status") {
+		return nil, errors.New("not a delivery status notification")
+	}
+
+	var (
+		dsn   *DSN
+		mr    = entity.MultipartReader()
+		msgID string
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil && !message.IsUnknownCharset(err) {
+			return nil, err
+		}
+		partType, _, _ := part.Header.ContentType()
+		switch partType {
+		case "message/delivery-status", "message/global-delivery-status":
+			if dsn, err = parseDeliveryStatus(part.Body); err != nil {
+				return nil, err
+			}
+		case "message/rfc822", "text/rfc822-headers",
+			"message/global", "message/global-headers":
+			header, err := textproto.ReadHeader(bufio.NewReader(part.Body))
+			if err == nil {
+				msgID = strings.Trim(header.Get("Message-Id"), "<> ")
+			}
+		}
+	}
+	if dsn == nil {
+		return nil, errors.New("delivery status notification has no delivery-status part")
+	}
+	dsn.MessageID = msgID
+	return dsn, nil
+}
+
+// Parses the per-message and per-recipient fields of a delivery-status part.
+func parseDeliveryStatus(r io.Reader) (*DSN, error) {
+	br := bufio.NewReader(r)
+	perMessage, err := textproto.ReadHeader(br)
+	if err != nil {
+		return nil, fmt.Errorf("invalid delivery-status: %v", err)
+	}
+	dsn := &DSN{ReportingMTA: typedValue(perMessage.Get("Reporting-MTA"))}
+
+	for {
+		// Skip blank lines between groups of fields
+		if b, err := br.Peek(1); err != nil {
+			break
+		} else if b[0] == '\r' || b[0] == '\n' {
+			br.ReadByte()
+			continue
+		}
+		fields, err := textproto.ReadHeader(br)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delivery-status: %v", err)
+		}
+		rcpt := DSNRecipient{
+			FinalRecipient:    typedValue(fields.Get("Final-Recipient")),
+			OriginalRecipient: typedValue(fields.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(fields.Get("Action"))),
+			Status:            strings.TrimSpace(fields.Get("Status")),
+			DiagnosticCode:    typedValue(fields.Get("Diagnostic-Code")),
+		}
+		// The status may be followed by a comment
+		if i := strings.IndexAny(rcpt.Status, " \t("); i != -1 {
+			rcpt.Status = rcpt.Status[:i]
+		}
+		if rcpt.FinalRecipient == "" {
+			return nil, errors.New("invalid delivery-status: missing Final-Recipient")
+		}
+		dsn.Recipients = append(dsn.Recipients, rcpt)
+	}
+	if len(dsn.Recipients) == 0 {
+		return nil, errors.New("invalid delivery-status: no recipients")
+	}
+	return dsn, nil
+}
+
+// Returns the value of a field of the form "type; value", e.g.
+// "rfc822; jdoe@example.org".
+func typedValue(field string) string {
+	if i := strings.IndexByte(field, ';'); i != -1 {
+		field = field[i+1:]
+	}
+	return strings.TrimSpace(field)
+}
@@ -0,0 +1,94 @@
+package email
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testDSN = `From: Mail Delivery System <MAILER-DAEMON@mx.example.org>
+To: bounces+rms=example.org@sr.ht
+Subject: Undelivered Mail Returned to Sender
+MIME-Version: 1.0
+Content-Type: multipart/report; report-type=delivery-status;
+	boundary="boundary"
+
+--boundary
+Content-Type: text/plain
+
+This is the mail system at host mx.example.org.
+
+--boundary
+Content-Type: message/delivery-status
+
+Reporting-MTA: dns; mx.example.org
+Arrival-Date: Mon, 18 Oct 2021 12:00:00 +0000
+
+Final-Recipient: rfc822; rms@example.org
+Original-Recipient: rfc822;RMS@example.org
+Action: failed
+Status: 5.1.1 (unknown user)
+Diagnostic-Code: smtp; 550 5.1.1 <rms@example.org>: Recipient address
+    rejected: User unknown
+
+Final-Recipient: rfc822; jdoe@example.org
+Action: delayed
+Status: 4.4.1
+Diagnostic-Code: smtp; 451 Try again later
+
+--boundary
+Content-Type: text/rfc822-headers
+
+Message-Id: <1234@sr.ht>
+Subject: Hello
+
+--boundary--
+`
+
+func TestParseDSN(t *testing.T) {
+	dsn, err := ParseDSN(strings.NewReader(
+		strings.ReplaceAll(testDSN, "\n", "\r\n")))
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+	assert.Equal(t, "mx.example.org", dsn.ReportingMTA)
+	assert.Equal(t, "1234@sr.ht", dsn.MessageID)
+	assert.Equal(t, []DSNRecipient{
+		{
+			FinalRecipient:    "rms@example.org",
+			OriginalRecipient: "RMS@example.org",
+			Action:            "failed",
+			Status:            "5.1.1",
+			DiagnosticCode: "550 5.1.1 <rms@example.org>: " +
+				"Recipient address rejected: User unknown",
+		},
+		{
+			FinalRecipient: "jdoe@example.org",
+			Action:         "delayed",
+			Status:         "4.4.1",
+			DiagnosticCode: "451 Try again later",
+		},
+	}, dsn.Recipients)
+	assert.Equal(t, []string{"RMS@example.org"}, dsn.Failed())
+
+	// LF line endings are tolerated
+	dsn, err = ParseDSN(strings.NewReader(testDSN))
+	assert.Nil(t, err)
+	assert.Len(t, dsn.Recipients, 2)
+}
+
+func TestParseDSNInvalid(t *testing.T) {
+	_, err := ParseDSN(strings.NewReader("Subject: Hello\r\n\r\nHello!\r\n"))
+	assert.NotNil(t, err)
+
+	_, err = ParseDSN(strings.NewReader(`Content-Type: multipart/report; report-type=delivery-status; boundary=b
+
+--b
+Content-Type: text/plain
+
+Your message could not be delivered.
+--b--
+`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,28 @@
+// Package emailtest provides utilities for testing code which sends email.
+package emailtest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// Returns the messages which have been delivered to a maildir, such as one
+// configured with [mail]transport=maildir for the test. The caller must first
+// dispatch the email queue.
+func Maildir(t testing.TB, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "new", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, string(b))
+	}
+	return msgs
+}
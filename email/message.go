@@ -0,0 +1,128 @@
+package email
+
+import (
+	"io"
+
+	"github.com/emersion/go-message/mail"
+)
+
+// The body of an email. Text is required, and the other fields are optional.
+// If HTML is set, it is included as an alternative to the text, in a
+// multipart/alternative message. If there are attachments, the message is
+// multipart/mixed.
+type Body struct {
+	Text        io.Reader
+	HTML        io.Reader
+	Attachments []Attachment
+}
+
+// A file attached to an email.
+type Attachment struct {
+	Filename    string
+	ContentType string
+	Body        io.Reader
+}
+
+// Writes a message with the given header and body. The header must not
+// contain any content headers.
+func writeMessage(w io.Writer, header mail.Header, body Body) error {
+	if body.HTML == nil && len(body.Attachments) == 0 {
+		header.SetContentType("text/plain", nil)
+		part, err := mail.CreateSingleInlineWriter(w, header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, body.Text); err != nil {
+			return err
+		}
+		return part.Close()
+	}
+
+	if len(body.Attachments) == 0 {
+		inline, err := mail.CreateInlineWriter(w, header)
+		if err != nil {
+			return err
+		}
+		if err := writeInline(inline, body); err != nil {
+			return err
+		}
+		return inline.Close()
+	}
+
+	mw, err := mail.CreateWriter(w, header)
+	if err != nil {
+		return err
+	}
+	if body.HTML == nil {
+		var h mail.InlineHeader
+		h.SetContentType("text/plain", nil)
+		part, err := mw.CreateSingleInline(h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, body.Text); err != nil {
+			return err
+		}
+		if err := part.Close(); err != nil {
+			return err
+		}
+	} else {
+		inline, err := mw.CreateInline()
+		if err != nil {
+			return err
+		}
+		if err := writeInline(inline, body); err != nil {
+			return err
+		}
+		if err := inline.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range body.Attachments {
+		var h mail.AttachmentHeader
+		contentType := a.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		h.SetContentType(contentType, nil)
+		h.SetFilename(a.Filename)
+		part, err := mw.CreateAttachment(h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, a.Body); err != nil {
+			return err
+		}
+		if err := part.Close(); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// Writes the text and HTML alternatives of a body.
+func writeInline(inline *mail.InlineWriter, body Body) error {
+	for _, alt := range []struct {
+		contentType string
+		r           io.Reader
+	}{
+		// Clients prefer the last alternative they support
+		{"text/plain", body.Text},
+		{"text/html", body.HTML},
+	} {
+		var h mail.InlineHeader
+		h.SetContentType(alt.contentType, map[string]string{"charset": "utf-8"})
+		part, err := inline.CreatePart(h)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, alt.r); err != nil {
+			return err
+		}
+		if err := part.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
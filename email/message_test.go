@@ -0,0 +1,139 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+)
+
+type testPart struct {
+	contentType string
+	filename    string
+	body        string
+}
+
+func readParts(t *testing.T, r io.Reader) (*mail.Reader, []testPart) {
+	mr, err := mail.CreateReader(r)
+	if err != nil {
+		panic(err)
+	}
+	var parts []testPart
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		var part testPart
+		switch h := p.Header.(type) {
+		case *mail.InlineHeader:
+			part.contentType, _, _ = h.ContentType()
+		case *mail.AttachmentHeader:
+			part.contentType, _, _ = h.ContentType()
+			part.filename, _ = h.Filename()
+		}
+		b, err := ioutil.ReadAll(p.Body)
+		assert.Nil(t, err)
+		part.body = string(b)
+		parts = append(parts, part)
+	}
+	return mr, parts
+}
+
+func TestWriteMessage(t *testing.T) {
+	var header mail.Header
+	header.SetSubject("Hello")
+	var buf bytes.Buffer
+	assert.Nil(t, writeMessage(&buf, header, Body{
+		Text: strings.NewReader("Hello world!"),
+		HTML: strings.NewReader("<p>Hello world!</p>"),
+	}))
+	mr, parts := readParts(t, &buf)
+	contentType, _, _ := mr.Header.ContentType()
+	assert.Equal(t, "multipart/alternative", contentType)
+	assert.Equal(t, []testPart{
+		{"text/plain", "", "Hello world!"},
+		{"text/html", "", "<p>Hello world!</p>"},
+	}, parts)
+
+	header = mail.Header{}
+	header.SetSubject("Hello")
+	buf.Reset()
+	assert.Nil(t, writeMessage(&buf, header, Body{
+		Text: strings.NewReader("See attached"),
+		Attachments: []Attachment{{
+			Filename:    "build.log",
+			ContentType: "text/plain",
+			Body:        strings.NewReader("+ make\n"),
+		}, {
+			Filename: "blob.bin",
+			Body:     bytes.NewReader([]byte{0, 1, 2}),
+		}},
+	}))
+	mr, parts = readParts(t, &buf)
+	contentType, _, _ = mr.Header.ContentType()
+	assert.Equal(t, "multipart/mixed", contentType)
+	assert.Equal(t, []testPart{
+		{"text/plain", "", "See attached"},
+		{"text/plain", "build.log", "+ make\n"},
+		{"application/octet-stream", "blob.bin", "\x00\x01\x02"},
+	}, parts)
+}
+
+func TestEnqueueMultipart(t *testing.T) {
+	dir := t.TempDir()
+	ctx := transportContext("transport=maildir\nmaildir=" + dir)
+
+	var header mail.Header
+	header.SetSubject("Hello")
+	header.SetAddressList("To", []*mail.Address{{Address: "rms@example.org"}})
+	header.Set("Content-Type", "text/x-bogus")
+	assert.Nil(t, EnqueueMultipart(ctx, header, Body{
+		Text: strings.NewReader("Hello world!"),
+		HTML: strings.NewReader("<p>Hello world!</p>"),
+		Attachments: []Attachment{{
+			Filename: "hello.patch",
+			Body:     strings.NewReader("diff"),
+		}},
+	}, nil))
+	ForContext(ctx).Queue.Dispatch(ctx)
+
+	msgs := emailtest.Maildir(t, dir)
+	if !assert.Len(t, msgs, 1) {
+		return
+	}
+
+	mr, err := mail.CreateReader(strings.NewReader(msgs[0]))
+	if err != nil {
+		panic(err)
+	}
+	contentType, _, _ := mr.Header.ContentType()
+	assert.Equal(t, "multipart/mixed", contentType)
+	for _, key := range []string{"Message-Id", "Date", "From", "Reply-To"} {
+		assert.True(t, mr.Header.Has(key), key)
+	}
+
+	// The inline alternatives are nested within the mixed message
+	var contentTypes []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		contentType, _, _ := p.Header.(interface {
+			ContentType() (string, map[string]string, error)
+		}).ContentType()
+		contentTypes = append(contentTypes, contentType)
+	}
+	assert.Equal(t, []string{
+		"text/plain", "text/html", "application/octet-stream",
+	}, contentTypes)
+}
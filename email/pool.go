@@ -0,0 +1,225 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/vaughan0/go-ini"
+)
+
+// Authenticated SMTP connections are kept open between messages, so that bulk
+// mail does not require a new connection, TLS handshake, and authentication
+// for every message. The pool is configured with the following options:
+//
+//	[mail]
+//	smtp-max-idle     number of idle connections to keep (default 2, 0 disables)
+//	smtp-idle-timeout time to keep an idle connection open (default 30s)
+//	smtp-max-messages messages to send before reconnecting (default 100)
+const (
+	defaultMaxIdle     = 2
+	defaultIdleTimeout = 30 * time.Second
+	defaultMaxMessages = 100
+)
+
+type connPool struct {
+	mutex       sync.Mutex
+	idle        []*pooledConn
+	maxIdle     int
+	idleTimeout time.Duration
+	maxMessages int
+}
+
+type pooledConn struct {
+	client    *smtp.Client
+	messages  int
+	idleSince time.Time
+}
+
+func newConnPool(conf ini.File) *connPool {
+	pool := &connPool{
+		maxIdle:     defaultMaxIdle,
+		idleTimeout: defaultIdleTimeout,
+		maxMessages: defaultMaxMessages,
+	}
+	if v, ok := conf.Get("mail", "smtp-max-idle"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			panic(fmt.Errorf("Unable to parse [mail]smtp-max-idle (must be a non-negative integer)"))
+		}
+		pool.maxIdle = n
+	}
+	if v, ok := conf.Get("mail", "smtp-idle-timeout"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			panic(fmt.Errorf("Unable to parse [mail]smtp-idle-timeout (must be a positive duration)"))
+		}
+		pool.idleTimeout = d
+	}
+	if v, ok := conf.Get("mail", "smtp-max-messages"); ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			panic(fmt.Errorf("Unable to parse [mail]smtp-max-messages (must be a positive integer)"))
+		}
+		pool.maxMessages = n
+	}
+	return pool
+}
+
+// Sends a message, reusing an idle connection if one is available. If the
+// idle connection turns out to have been closed, a new connection is made.
+func (pool *connPool) send(ctx context.Context,
+	from string, msg []byte, rcpts []string) error {
+	if conn := pool.get(); conn != nil {
+		// RSET also verifies that the server has not closed the connection
+		// since it was last used
+		err := conn.client.Reset()
+		if err == nil {
+			err = conn.send(from, msg, rcpts)
+		}
+		if err == nil || isRejection(err) {
+			pool.put(conn)
+			return err
+		}
+		conn.client.Close()
+	}
+
+	c, _, err := mailSetup(ctx)
+	if err != nil {
+		return err
+	}
+	conn := &pooledConn{client: c}
+	err = conn.send(from, msg, rcpts)
+	if err == nil || isRejection(err) {
+		pool.put(conn)
+		return err
+	}
+	conn.client.Close()
+	return err
+}
+
+// Returns true if the server rejected a message or some of its recipients
+// without closing the connection, in which case the connection may be used for
+// other messages.
+func isRejection(err error) bool {
+	var rejected RejectedRecipients
+	if errors.As(err, &rejected) {
+		return true
+	}
+	var serr *smtp.SMTPError
+	return errors.As(err, &serr) && serr.Code != 421
+}
+
+// Returns the most recently used idle connection, or nil if there is none.
+func (pool *connPool) get() *pooledConn {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for len(pool.idle) > 0 {
+		conn := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if time.Since(conn.idleSince) < pool.idleTimeout {
+			return conn
+		}
+		go conn.close()
+	}
+	return nil
+}
+
+// Returns a connection to the pool after use, or closes it if the pool is
+// full or the connection has been used for too many messages.
+func (pool *connPool) put(conn *pooledConn) {
+	if conn.messages >= pool.maxMessages {
+		conn.close()
+		return
+	}
+
+	pool.mutex.Lock()
+	if len(pool.idle) >= pool.maxIdle {
+		pool.mutex.Unlock()
+		conn.close()
+		return
+	}
+	conn.idleSince = time.Now()
+	pool.idle = append(pool.idle, conn)
+	pool.mutex.Unlock()
+
+	time.AfterFunc(pool.idleTimeout, pool.prune)
+}
+
+// Closes connections which have been idle for longer than the idle timeout.
+func (pool *connPool) prune() {
+	var expired []*pooledConn
+	pool.mutex.Lock()
+	idle := pool.idle[:0]
+	for _, conn := range pool.idle {
+		if time.Since(conn.idleSince) < pool.idleTimeout {
+			idle = append(idle, conn)
+		} else {
+			expired = append(expired, conn)
+		}
+	}
+	pool.idle = idle
+	pool.mutex.Unlock()
+
+	for _, conn := range expired {
+		conn.close()
+	}
+}
+
+func (conn *pooledConn) send(from string, msg []byte, rcpts []string) error {
+	c := conn.client
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+	rejected, err := addRecipients(c, rcpts)
+	if err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	conn.messages++
+	if len(rejected) != 0 {
+		return rejected
+	}
+	return nil
+}
+
+// Sends RCPT for each recipient. Recipients which are permanently rejected are
+// skipped and returned, so that one bad address does not prevent delivery to
+// the others. An error is returned if a recipient is rejected for any other
+// reason, or if every recipient was rejected.
+func addRecipients(c *smtp.Client, rcpts []string) (RejectedRecipients, error) {
+	var rejected RejectedRecipients
+	for _, rcpt := range rcpts {
+		err := c.Rcpt(rcpt)
+		if err == nil {
+			continue
+		}
+		if !IsPermanent(err) {
+			return nil, err
+		}
+		rejected = append(rejected, RecipientError{rcpt, err})
+	}
+	if len(rejected) == len(rcpts) && len(rejected) != 0 {
+		return nil, rejected[0].Err
+	}
+	return rejected, nil
+}
+
+func (conn *pooledConn) close() {
+	if err := conn.client.Quit(); err != nil {
+		conn.client.Close()
+	}
+}
@@ -0,0 +1,150 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+)
+
+type testBackend struct {
+	mutex    sync.Mutex
+	sessions int
+	senders  []string
+	messages []string
+}
+
+func (be *testBackend) NewSession(c smtp.ConnectionState,
+	hostname string) (smtp.Session, error) {
+	be.mutex.Lock()
+	defer be.mutex.Unlock()
+	be.sessions++
+	return &testSession{be}, nil
+}
+
+type testSession struct {
+	be *testBackend
+}
+
+func (s *testSession) Reset()                                    {}
+func (s *testSession) Logout() error                             { return nil }
+func (s *testSession) AuthPlain(username, password string) error { return nil }
+
+func (s *testSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.be.mutex.Lock()
+	defer s.be.mutex.Unlock()
+	s.be.senders = append(s.be.senders, from)
+	return nil
+}
+
+func (s *testSession) Rcpt(to string) error {
+	if strings.HasPrefix(to, "unknown@") {
+		return &smtp.SMTPError{Code: 550, Message: "No such user"}
+	} else if strings.HasPrefix(to, "busy@") {
+		return &smtp.SMTPError{Code: 451, Message: "Try again later"}
+	}
+	return nil
+}
+
+func (s *testSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.be.mutex.Lock()
+	defer s.be.mutex.Unlock()
+	s.be.messages = append(s.be.messages, string(b))
+	return nil
+}
+
+// Starts an SMTP server and returns a context configured to use it.
+func testServer(t *testing.T, options string) (context.Context, *testBackend) {
+	be := &testBackend{}
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	conf, err := ini.Load(strings.NewReader(fmt.Sprintf(`
+[sr.ht]
+owner-name=Jane Doe
+owner-email=jdoe@example.org
+
+[mail]
+smtp-host=127.0.0.1
+smtp-port=%d
+smtp-from=test@example.org
+smtp-encryption=insecure
+smtp-auth=none
+%s`, l.Addr().(*net.TCPAddr).Port, options)))
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), conf, "test")
+	return Context(ctx, NewQueue(conf)), be
+}
+
+func TestSendPooled(t *testing.T) {
+	ctx, be := testServer(t, "smtp-max-messages=3")
+	rcpts := []string{"jdoe@example.org"}
+	for i := 0; i < 4; i++ {
+		msg := fmt.Sprintf("Subject: %d\r\n\r\nHello!\r\n", i)
+		assert.Nil(t, Send(ctx, bytes.NewBufferString(msg), rcpts))
+	}
+	assert.Len(t, be.messages, 4)
+	assert.Equal(t, 2, be.sessions)
+
+	// Rejected messages do not close the connection
+	err := Send(ctx, bytes.NewBufferString("\r\nHello!\r\n"),
+		[]string{"unknown@example.org"})
+	assert.NotNil(t, err)
+	assert.Nil(t, Send(ctx, bytes.NewBufferString("\r\nHello!\r\n"), rcpts))
+	assert.Equal(t, 2, be.sessions)
+
+	// Connections closed while idle are replaced
+	pool := ForContext(ctx).transport.(*connPool)
+	assert.Len(t, pool.idle, 1)
+	pool.idle[0].client.Close()
+	assert.Nil(t, Send(ctx, bytes.NewBufferString("\r\nHello!\r\n"), rcpts))
+	assert.Len(t, be.messages, 6)
+	assert.Equal(t, 3, be.sessions)
+
+	// Messages with some rejected recipients are still delivered to the
+	// others, and do not close the connection either
+	err = Send(ctx, bytes.NewBufferString("\r\nHello!\r\n"),
+		[]string{"unknown@example.org", "jdoe@example.org"})
+	var rejected RejectedRecipients
+	if assert.True(t, errors.As(err, &rejected)) && assert.Len(t, rejected, 1) {
+		assert.Equal(t, "unknown@example.org", rejected[0].Recipient)
+	}
+	assert.Len(t, be.messages, 7)
+	assert.Len(t, pool.idle, 1)
+	assert.Equal(t, 3, be.sessions)
+}
+
+func TestSendUnpooled(t *testing.T) {
+	ctx, be := testServer(t, "smtp-max-idle=0")
+	rcpts := []string{"jdoe@example.org"}
+	for i := 0; i < 2; i++ {
+		assert.Nil(t, Send(ctx, bytes.NewBufferString("\r\nHello!\r\n"), rcpts))
+	}
+	assert.Len(t, be.messages, 2)
+	assert.Equal(t, 2, be.sessions)
+	assert.Len(t, ForContext(ctx).transport.(*connPool).idle, 0)
+}
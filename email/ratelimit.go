@@ -0,0 +1,317 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	work "git.sr.ht/~sircmpwn/dowork"
+	"github.com/emersion/go-message/mail"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/redis"
+)
+
+// Notifications sent with EnqueueNotification are subject to a limit on the
+// number of messages each recipient receives, configured with:
+//
+//	[mail]
+//	rate-limit        messages per recipient per window (default 0, unlimited)
+//	rate-limit-window the length of the window (default 1h)
+//
+// Notifications over the limit are combined into a digest, which is sent to
+// the recipient when the window ends. The counters and pending digests are
+// stored in Redis, so the limit applies across all instances of the service.
+//
+// Only EnqueueNotification and EnqueueTemplateNotification are limited. Mail
+// sent with Enqueue, EnqueueStd, EnqueueMultipart, EnqueueTemplate or Send is
+// always delivered right away, so that messages the user asked for, such as
+// password resets, are not held back by notifications. Digests only include
+// the plain text part of each notification.
+const defaultRateLimitWindow = time.Hour
+
+type rateLimit struct {
+	limit  int64
+	window time.Duration
+}
+
+// A notification which has been deferred to a digest.
+type digestEntry struct {
+	Subject string
+	Date    time.Time
+	Body    string
+	RcptKey *string `json:",omitempty"`
+}
+
+func loadRateLimit(conf ini.File) *rateLimit {
+	v, ok := conf.Get("mail", "rate-limit")
+	if !ok {
+		return nil
+	}
+	limit, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || limit < 0 {
+		panic(fmt.Errorf("Unable to parse [mail]rate-limit (must be a non-negative integer)"))
+	}
+	if limit == 0 {
+		return nil
+	}
+	rl := &rateLimit{limit: limit, window: defaultRateLimitWindow}
+	if v, ok := conf.Get("mail", "rate-limit-window"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			panic(fmt.Errorf("Unable to parse [mail]rate-limit-window (must be a positive duration)"))
+		}
+		rl.window = d
+	}
+	return rl
+}
+
+func rateLimitKey(ctx context.Context, kind, rcpt string) string {
+	return fmt.Sprintf("email:%s:%s:%s", config.ServiceName(ctx),
+		kind, strings.ToLower(rcpt))
+}
+
+// Like EnqueueStd, but intended for automated notifications, which are
+// subject to the per-recipient rate limit. Recipients who are over the limit
+// receive the notification as part of a digest once the limit resets.
+//
+// The caller's header is not modified.
+func EnqueueNotification(ctx context.Context, header mail.Header,
+	bodyReader io.Reader, rcptKey *string) error {
+	return enqueueNotification(ctx, header, Body{Text: bodyReader}, rcptKey)
+}
+
+func enqueueNotification(ctx context.Context, header mail.Header,
+	body Body, rcptKey *string) error {
+	queue := ForContext(ctx)
+	if queue.rateLimit == nil {
+		return EnqueueMultipart(ctx, header, body, rcptKey)
+	}
+	// The recipients are narrowed down to those under the limit below
+	header = header.Copy()
+
+	to, err := header.AddressList("To")
+	if err != nil {
+		return fmt.Errorf("invalid To header field: %v", err)
+	}
+	cc, err := header.AddressList("Cc")
+	if err != nil {
+		return fmt.Errorf("invalid Cc header field: %v", err)
+	}
+	text, err := ioutil.ReadAll(body.Text)
+	if err != nil {
+		return err
+	}
+	subject, err := header.Subject()
+	if err != nil {
+		return err
+	}
+	entry := digestEntry{
+		Subject: subject,
+		Date:    time.Now().UTC(),
+		Body:    string(text),
+		RcptKey: rcptKey,
+	}
+
+	var allowed, allowedCc []*mail.Address
+	for i, addr := range append(to, cc...) {
+		ok, err := queue.rateLimit.allow(ctx, addr.Address)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			if err := queue.rateLimit.addToDigest(ctx, addr.Address, &entry); err != nil {
+				return err
+			}
+		} else if i < len(to) {
+			allowed = append(allowed, addr)
+		} else {
+			allowedCc = append(allowedCc, addr)
+		}
+	}
+	if len(allowed) == 0 && len(allowedCc) == 0 {
+		return nil
+	}
+
+	header.SetAddressList("To", allowed)
+	if len(allowedCc) != 0 {
+		header.SetAddressList("Cc", allowedCc)
+	} else {
+		header.Del("Cc")
+	}
+	body.Text = bytes.NewReader(text)
+	return EnqueueMultipart(ctx, header, body, rcptKey)
+}
+
+// Counts a message to the recipient against their limit, and returns true if
+// it may be sent now.
+func (rl *rateLimit) allow(ctx context.Context, rcpt string) (bool, error) {
+	key := rateLimitKey(ctx, "ratelimit", rcpt)
+	var incr *goredis.IntCmd
+	_, err := redis.ForContext(ctx).TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		// The window starts with the first message
+		pipe.SetNX(ctx, key, 0, rl.window)
+		incr = pipe.Incr(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return incr.Val() <= rl.limit, nil
+}
+
+// Adds a message to the recipient's digest, and schedules the digest to be
+// sent when the recipient's window ends, if it has not been already.
+func (rl *rateLimit) addToDigest(ctx context.Context, rcpt string, entry *digestEntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	digestKey := rateLimitKey(ctx, "digest", rcpt)
+	_, err = redis.ForContext(ctx).TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.RPush(ctx, digestKey, b)
+		// The digest is due within a window, and is kept for another window
+		// after that in case it is not sent, e.g. because Redis is down
+		pipe.PExpire(ctx, digestKey, 2*rl.window)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return rl.scheduleDigest(ctx, rcpt)
+}
+
+// Schedules the recipient's digest to be sent when their window ends, unless
+// it has been scheduled already.
+func (rl *rateLimit) scheduleDigest(ctx context.Context, rcpt string) error {
+	rc := redis.ForContext(ctx)
+	due, err := rc.PTTL(ctx, rateLimitKey(ctx, "ratelimit", rcpt)).Result()
+	if err != nil {
+		return err
+	}
+	if due < 0 {
+		due = 0
+	}
+
+	// The marker expires in case the instance which scheduled the digest
+	// goes away before sending it, so that the next notification schedules
+	// it again
+	dueAt := time.Now().Add(due).UTC()
+	scheduled, err := rc.SetNX(ctx, rateLimitKey(ctx, "digest-due", rcpt),
+		dueAt.Format(time.RFC3339), due+rl.window).Result()
+	if err != nil || !scheduled {
+		return err
+	}
+	return enqueueDigest(ctx, rcpt, dueAt)
+}
+
+func enqueueDigest(ctx context.Context, rcpt string, due time.Time) error {
+	task := work.NewTask(func(ctx context.Context) error {
+		return sendDigest(ctx, rcpt)
+	}).Retries(5).NotBefore(due)
+	return ForContext(ctx).Enqueue(task)
+}
+
+// Schedules the digests which are pending in Redis, e.g. because the instance
+// which scheduled them was stopped before they were due. Digests which are
+// overdue are sent right away. The server calls this when it starts.
+//
+// Digests which another instance is still waiting to send may be scheduled
+// twice. This is harmless: whichever attempt comes second finds the digest
+// empty and sends nothing.
+func (queue *Queue) ScheduleDigests(ctx context.Context) error {
+	if queue.rateLimit == nil {
+		return nil
+	}
+	rc := redis.ForContext(ctx)
+	prefix := rateLimitKey(ctx, "digest", "")
+	iter := rc.Scan(ctx, 0, prefix+"*", 0).Iterator()
+	for iter.Next(ctx) {
+		rcpt := strings.TrimPrefix(iter.Val(), prefix)
+		due := time.Now().UTC()
+		v, err := rc.Get(ctx, rateLimitKey(ctx, "digest-due", rcpt)).Result()
+		if err == nil {
+			if t, err := time.Parse(time.RFC3339, v); err == nil && t.After(due) {
+				due = t
+			}
+		} else if err != goredis.Nil {
+			return err
+		}
+		if err := enqueueDigest(ctx, rcpt, due); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// Sends the pending digest for a recipient, if any.
+func sendDigest(ctx context.Context, rcpt string) error {
+	rc := redis.ForContext(ctx)
+	digestKey := rateLimitKey(ctx, "digest", rcpt)
+	dueKey := rateLimitKey(ctx, "digest-due", rcpt)
+	raw, err := rc.LRange(ctx, digestKey, 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	if len(raw) == 0 {
+		return rc.Del(ctx, dueKey).Err()
+	}
+
+	var (
+		entries []digestEntry
+		rcptKey *string
+	)
+	for _, b := range raw {
+		var entry digestEntry
+		if err := json.Unmarshal([]byte(b), &entry); err != nil {
+			log.Printf("Discarding invalid digest entry for %s: %v", rcpt, err)
+			continue
+		}
+		if entry.RcptKey != nil {
+			rcptKey = entry.RcptKey
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 0 {
+		var header mail.Header
+		header.SetAddressList("To", []*mail.Address{{Address: rcpt}})
+		data := struct {
+			Messages []digestEntry
+		}{entries}
+		// The entries are kept in Redis until the digest is queued, so that
+		// they are sent by the next attempt if this fails
+		if err := EnqueueTemplate(ctx, header, "digest", "", &data, rcptKey); err != nil {
+			log.Printf("Unable to send digest to %s: %v", rcpt, err)
+			return err
+		}
+	}
+
+	// Only the entries which were sent are removed. Any which were added in
+	// the meantime go into the next digest.
+	var remaining *goredis.IntCmd
+	_, err = rc.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.LTrim(ctx, digestKey, int64(len(raw)), -1)
+		remaining = pipe.LLen(ctx, digestKey)
+		pipe.Del(ctx, dueKey)
+		return nil
+	})
+	if err != nil {
+		// Re-attempting would send the digest again
+		log.Printf("Unable to remove sent digest for %s: %v", rcpt, err)
+		return fmt.Errorf("%w: %v", work.ErrDoNotReattempt, err)
+	}
+	if remaining.Val() == 0 {
+		return nil
+	}
+	return ForContext(ctx).rateLimit.scheduleDigest(ctx, rcpt)
+}
@@ -0,0 +1,175 @@
+package email
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/emersion/go-message/mail"
+	goredis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+	"git.sr.ht/~sircmpwn/core-go/redis"
+)
+
+// Returns a context with a rate-limited queue and a Redis server.
+func rateLimitContext(t *testing.T) (context.Context, *miniredis.Miniredis, string) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(mr.Close)
+	maildir := filepath.Join(t.TempDir(), "maildir")
+	ctx := transportContext("transport=maildir\nmaildir=" + maildir +
+		"\nrate-limit=2\nrate-limit-window=10m")
+	ctx = redis.Context(ctx, goredis.NewClient(&goredis.Options{Addr: mr.Addr()}))
+	return ctx, mr, maildir
+}
+
+func notify(t *testing.T, ctx context.Context, subject string, to ...string) {
+	var header mail.Header
+	header.SetSubject(subject)
+	var addrs []*mail.Address
+	for _, addr := range to {
+		addrs = append(addrs, &mail.Address{Address: addr})
+	}
+	header.SetAddressList("To", addrs)
+	assert.Nil(t, EnqueueNotification(ctx, header,
+		strings.NewReader("Body of "+subject), nil))
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx, mr, maildir := rateLimitContext(t)
+	queue := ForContext(ctx)
+
+	notify(t, ctx, "One", "rms@example.org")
+	notify(t, ctx, "Two", "rms@example.org", "jdoe@example.org")
+	notify(t, ctx, "Three", "rms@example.org", "jdoe@example.org")
+	notify(t, ctx, "Four", "RMS@example.org")
+	queue.Dispatch(ctx)
+
+	// rms receives two notifications right away, and jdoe receives both
+	assert.Len(t, emailtest.Maildir(t, maildir), 3)
+
+	key := "email:test:digest:rms@example.org"
+	entries, err := mr.List(key)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.True(t, mr.Exists("email:test:digest-due:rms@example.org"))
+	ttl := mr.TTL("email:test:ratelimit:rms@example.org")
+	assert.True(t, ttl > 0 && ttl <= 10*time.Minute)
+	assert.Equal(t, 20*time.Minute, mr.TTL(key))
+
+	// The digest is sent once the window ends
+	assert.Nil(t, sendDigest(ctx, "rms@example.org"))
+	queue.Dispatch(ctx)
+	msgs := emailtest.Maildir(t, maildir)
+	if assert.Len(t, msgs, 4) {
+		var digest string
+		for _, msg := range msgs {
+			if strings.Contains(msg, "combined into this digest") {
+				digest = msg
+			}
+		}
+		assert.Contains(t, digest, "Subject: Three")
+		assert.Contains(t, digest, "Body of Three")
+		assert.Contains(t, digest, "Subject: Four")
+		assert.Contains(t, digest, "Body of Four")
+		assert.NotContains(t, digest, "Body of Two")
+	}
+	assert.False(t, mr.Exists(key))
+	assert.False(t, mr.Exists("email:test:digest-due:rms@example.org"))
+
+	// An empty digest is not sent
+	assert.Nil(t, sendDigest(ctx, "rms@example.org"))
+	queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 4)
+
+	// The limit resets with the window
+	mr.FastForward(10 * time.Minute)
+	notify(t, ctx, "Five", "rms@example.org")
+	queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 5)
+}
+
+func TestRateLimitHeader(t *testing.T) {
+	ctx, _, _ := rateLimitContext(t)
+	notify(t, ctx, "One", "rms@example.org")
+	notify(t, ctx, "Two", "rms@example.org")
+
+	// The caller's header keeps the recipients who are over the limit
+	var header mail.Header
+	header.SetSubject("Three")
+	header.SetAddressList("To", []*mail.Address{
+		{Address: "rms@example.org"},
+		{Address: "jdoe@example.org"},
+	})
+	header.SetAddressList("Cc", []*mail.Address{{Address: "rms@example.org"}})
+	assert.Nil(t, EnqueueNotification(ctx, header,
+		strings.NewReader("Body of Three"), nil))
+	to, err := header.AddressList("To")
+	assert.Nil(t, err)
+	assert.Len(t, to, 2)
+	assert.True(t, header.Has("Cc"))
+}
+
+func TestTemplateNotification(t *testing.T) {
+	ctx, mr, maildir := rateLimitContext(t)
+	notify(t, ctx, "One", "rms@example.org")
+	notify(t, ctx, "Two", "rms@example.org")
+
+	var header mail.Header
+	header.SetAddressList("To", []*mail.Address{{Address: "rms@example.org"}})
+	assert.Nil(t, EnqueueTemplateNotification(ctx, header, "graphql-error", "",
+		map[string]interface{}{
+			"Error": errors.New("oh no"),
+			"Stack": "goroutine 1 [running]:",
+		}, nil))
+	ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 2)
+
+	// The rendered template is added to the digest
+	entries, err := mr.List("email:test:digest:rms@example.org")
+	assert.Nil(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Contains(t, entries[0], "GraphQL query error: oh no")
+		assert.Contains(t, entries[0], "goroutine 1 [running]:")
+	}
+}
+
+func TestDigestFailure(t *testing.T) {
+	ctx, mr, maildir := rateLimitContext(t)
+	queue := ForContext(ctx)
+	key := "email:test:digest:rms@example.org"
+
+	// Entries are kept if the digest cannot be queued
+	_, err := mr.Push(key, `{"Subject":"One","Body":"Body of One",`+
+		`"RcptKey":"not a certificate"}`)
+	assert.Nil(t, err)
+	assert.NotNil(t, sendDigest(ctx, "rms@example.org"))
+	entries, err := mr.List(key)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// Pending digests are scheduled again at startup, e.g. after the instance
+	// which scheduled them was restarted
+	mr.Del(key)
+	_, err = mr.Push(key, `{"Subject":"Two","Body":"Body of Two"}`)
+	assert.Nil(t, err)
+	assert.Nil(t, mr.Set("email:test:digest-due:rms@example.org",
+		time.Now().Add(-time.Minute).UTC().Format(time.RFC3339)))
+	assert.Nil(t, queue.ScheduleDigests(ctx))
+	queue.Dispatch(ctx) // sends the digest
+	queue.Dispatch(ctx) // sends the email
+	msgs := emailtest.Maildir(t, maildir)
+	if assert.Len(t, msgs, 1) {
+		assert.Contains(t, msgs[0], "Body of Two")
+	}
+	assert.False(t, mr.Exists(key))
+	assert.False(t, mr.Exists("email:test:digest-due:rms@example.org"))
+}
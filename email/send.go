@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/mail"
 	"strconv"
 
@@ -116,12 +117,24 @@ func mailSetup(ctx context.Context) (*smtp.Client, *mail.Address, error) {
 	return c, sender, nil
 }
 
-// Sends an email. Blocks until it's sent or an error occurs.
+// Sends an email with the configured transport. Blocks until it's sent or an
+// error occurs.
+//
+// If the context includes an email worker, its transport is used, so that
+// SMTP connections are pooled.
+//
+// If the server permanently rejects some, but not all, of the recipients, the
+// message is delivered to the others and a RejectedRecipients error is
+// returned.
 func Send(ctx context.Context, msg io.Reader, rcpts []string) error {
-	c, sender, err := mailSetup(ctx)
+	buf, err := ioutil.ReadAll(msg)
 	if err != nil {
 		return err
 	}
-	defer c.Close()
-	return c.SendMail(sender.Address, rcpts, msg)
+	conf := config.ForContext(ctx)
+	from := envelopeSender(conf, rcpts)
+	if queue, ok := ctx.Value(emailCtxKey).(*Queue); ok {
+		return queue.transport.send(ctx, from, buf, rcpts)
+	}
+	return newTransport(conf, false).send(ctx, from, buf, rcpts)
 }
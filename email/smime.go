@@ -0,0 +1,285 @@
+package email
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"sync"
+
+	"github.com/emersion/go-message"
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-message/textproto"
+	"github.com/vaughan0/go-ini"
+	"go.mozilla.org/pkcs7"
+)
+
+// Outgoing mail is signed with S/MIME if the following options are set:
+//
+//	[mail]
+//	smime-certificate - path to the PEM-encoded signing certificate, followed
+//	                    by any intermediate certificates
+//	smime-private-key - path to the PEM-encoded private key
+//
+// Messages are additionally encrypted if the sender provides the recipient's
+// PEM-encoded certificate as the rcptKey argument to EnqueueStd.
+type smimeSigner struct {
+	cert  *x509.Certificate
+	chain []*x509.Certificate
+	key   crypto.PrivateKey
+}
+
+// The pkcs7 package selects the content encryption algorithm with a global,
+// which defaults to DES-CBC. We only change it while encrypting, so as not to
+// affect other users of the package.
+var encryptMutex sync.Mutex
+
+// Loads the configured S/MIME signing key, or returns nil if S/MIME signing is
+// not configured.
+func loadSMIMESigner(conf ini.File) *smimeSigner {
+	certPath, ok := conf.Get("mail", "smime-certificate")
+	if !ok {
+		return nil
+	}
+	keyPath, ok := conf.Get("mail", "smime-private-key")
+	if !ok {
+		panic(fmt.Errorf("Missing S/MIME configuration options [smime-private-key]"))
+	}
+
+	certPEM, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read [mail]smime-certificate: %v", err))
+	}
+	certs, err := parseCertificates(certPEM)
+	if err != nil || len(certs) == 0 {
+		panic(fmt.Errorf("Unable to parse [mail]smime-certificate: %v", err))
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		panic(fmt.Errorf("Unable to read [mail]smime-private-key: %v", err))
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse [mail]smime-private-key: %v", err))
+	}
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		panic(fmt.Errorf("Unable to use [mail]smime-private-key: ed25519 keys are not supported"))
+	}
+
+	return &smimeSigner{
+		cert:  certs[0],
+		chain: certs[1:],
+		key:   key,
+	}
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// Parses a PEM-encoded RSA, ECDSA, or ed25519 private key.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		case ed25519.PrivateKey:
+			return key, nil
+		}
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+	return nil, fmt.Errorf("unsupported PEM block %s", block.Type)
+}
+
+// Writes a message with the given header and body, signed with the signer
+// (if not nil) and encrypted to the PEM-encoded certificate in rcptKey (if
+// not nil).
+func writeSMIME(w io.Writer, header mail.Header, body Body,
+	signer *smimeSigner, rcptKey *string) error {
+	var rcpt *x509.Certificate
+	if rcptKey != nil {
+		certs, err := parseCertificates([]byte(*rcptKey))
+		if err != nil {
+			return fmt.Errorf("invalid recipient certificate: %v", err)
+		}
+		if len(certs) == 0 {
+			return errors.New("invalid recipient certificate: no certificate found")
+		}
+		rcpt = certs[0]
+	}
+
+	// Signed content must not be altered in transit, so it must be 7-bit
+	// with CRLF line endings (RFC 8551, section 3.1). writeMessage encodes
+	// text parts as quoted-printable and other parts as base64, so only the
+	// line endings remain to be canonicalized.
+	var content bytes.Buffer
+	if err := writeMessage(&content, mail.Header{}, body); err != nil {
+		return err
+	}
+	var (
+		h      message.Header
+		entity = canonicalizeCRLF(content.Bytes())
+	)
+	if signer != nil {
+		var err error
+		h, entity, err = signer.sign(entity)
+		if err != nil {
+			return err
+		}
+	}
+	if rcpt != nil {
+		if signer != nil {
+			// The signed entity is encrypted as a whole
+			var buf bytes.Buffer
+			if err := textproto.WriteHeader(&buf, h.Header); err != nil {
+				return err
+			}
+			buf.Write(entity)
+			entity = buf.Bytes()
+		}
+		var err error
+		h, entity, err = encrypt(entity, rcpt)
+		if err != nil {
+			return err
+		}
+	}
+
+	fields := h.Fields()
+	for fields.Next() {
+		header.Set(fields.Key(), fields.Value())
+	}
+	header.Set("MIME-Version", "1.0")
+	if err := textproto.WriteHeader(w, header.Header.Header); err != nil {
+		return err
+	}
+	_, err := w.Write(entity)
+	return err
+}
+
+// Signs a MIME entity, returning the header and body of the multipart/signed
+// entity which contains it.
+func (s *smimeSigner) sign(entity []byte) (message.Header, []byte, error) {
+	var h message.Header
+	sd, err := pkcs7.NewSignedData(entity)
+	if err != nil {
+		return h, nil, err
+	}
+	sd.SetDigestAlgorithm(pkcs7.OIDDigestAlgorithmSHA256)
+	if err := sd.AddSignerChain(s.cert, s.key, s.chain,
+		pkcs7.SignerInfoConfig{}); err != nil {
+		return h, nil, err
+	}
+	sd.Detach()
+	sig, err := sd.Finish()
+	if err != nil {
+		return h, nil, err
+	}
+
+	boundary := randomBoundary()
+	h.Set("Content-Type", mime.FormatMediaType("multipart/signed",
+		map[string]string{
+			"protocol": "application/pkcs7-signature",
+			"micalg":   "sha-256",
+			"boundary": boundary,
+		}))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "--%s\r\n", boundary)
+	buf.Write(entity)
+	fmt.Fprintf(&buf, "\r\n--%s\r\n", boundary)
+	buf.WriteString("Content-Type: application/pkcs7-signature; name=smime.p7s\r\n")
+	buf.WriteString("Content-Transfer-Encoding: base64\r\n")
+	buf.WriteString("Content-Disposition: attachment; filename=smime.p7s\r\n\r\n")
+	buf.Write(wrapBase64(sig))
+	fmt.Fprintf(&buf, "--%s--\r\n", boundary)
+	return h, buf.Bytes(), nil
+}
+
+// Encrypts a MIME entity to a recipient, returning the header and body of the
+// application/pkcs7-mime entity which contains it.
+func encrypt(entity []byte, rcpt *x509.Certificate) (message.Header, []byte, error) {
+	var h message.Header
+	encryptMutex.Lock()
+	alg := pkcs7.ContentEncryptionAlgorithm
+	pkcs7.ContentEncryptionAlgorithm = pkcs7.EncryptionAlgorithmAES256CBC
+	enveloped, err := pkcs7.Encrypt(entity, []*x509.Certificate{rcpt})
+	pkcs7.ContentEncryptionAlgorithm = alg
+	encryptMutex.Unlock()
+	if err != nil {
+		return h, nil, err
+	}
+	h.Set("Content-Type", "application/pkcs7-mime; smime-type=enveloped-data; name=smime.p7m")
+	h.Set("Content-Transfer-Encoding", "base64")
+	h.Set("Content-Disposition", "attachment; filename=smime.p7m")
+	return h, wrapBase64(enveloped), nil
+}
+
+// Converts all line endings to CRLF.
+func canonicalizeCRLF(data []byte) []byte {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	return bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n"))
+}
+
+func randomBoundary() string {
+	var buf [30]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// Encodes data as base64 in lines of 76 characters.
+func wrapBase64(data []byte) []byte {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76])
+		buf.WriteString("\r\n")
+		encoded = encoded[76:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteString("\r\n")
+	return buf.Bytes()
+}
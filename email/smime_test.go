@@ -0,0 +1,202 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/stretchr/testify/assert"
+	"go.mozilla.org/pkcs7"
+
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+)
+
+// Generates a self-signed certificate and returns it and its private key.
+func testCertificate(name string) (*x509.Certificate, *rsa.PrivateKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		Subject:        pkix.Name{CommonName: name},
+		EmailAddresses: []string{name},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage: x509.KeyUsageDigitalSignature |
+			x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert, key
+}
+
+func certPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// Sends a message with S/MIME signing and returns the delivered message.
+func sendSMIME(t *testing.T, body string,
+	rcptKey *string) (*x509.Certificate, []byte) {
+	dir := t.TempDir()
+	cert, key := testCertificate("test@example.org")
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, certPEM(cert), 0600); err != nil {
+		panic(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600); err != nil {
+		panic(err)
+	}
+
+	maildir := filepath.Join(dir, "maildir")
+	ctx := transportContext("transport=maildir\nmaildir=" + maildir +
+		"\nsmime-certificate=" + certPath + "\nsmime-private-key=" + keyPath)
+
+	var header mail.Header
+	header.SetSubject("Hello")
+	header.SetAddressList("To", []*mail.Address{{Address: "rms@example.org"}})
+	assert.Nil(t, EnqueueStd(ctx, header,
+		strings.NewReader(body), rcptKey))
+	ForContext(ctx).Queue.Dispatch(ctx)
+
+	msgs := emailtest.Maildir(t, maildir)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message, got %d", len(msgs))
+	}
+	return cert, []byte(msgs[0])
+}
+
+// Splits a message into its header and body.
+func splitMessage(msg []byte) (mail.Header, []byte) {
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	r, err := mail.CreateReader(bytes.NewReader(msg[:i+4]))
+	if err != nil {
+		panic(err)
+	}
+	return r.Header, msg[i+4:]
+}
+
+// Verifies a multipart/signed message and returns the signed entity.
+func verifySigned(t *testing.T, signer *x509.Certificate, msg []byte) []byte {
+	header, body := splitMessage(msg)
+	contentType, params, err := header.ContentType()
+	assert.Nil(t, err)
+	assert.Equal(t, "multipart/signed", contentType)
+	assert.Equal(t, "application/pkcs7-signature", params["protocol"])
+
+	delim := "--" + params["boundary"]
+	parts := strings.Split(string(body), "\r\n"+delim)
+	if !assert.Len(t, parts, 3) {
+		t.FailNow()
+	}
+	entity := []byte(strings.TrimPrefix(parts[0], delim+"\r\n"))
+
+	sigHeader, sigBody := splitMessage([]byte(strings.TrimPrefix(parts[1], "\r\n")))
+	contentType, _, _ = sigHeader.ContentType()
+	assert.Equal(t, "application/pkcs7-signature", contentType)
+	sig, err := base64.StdEncoding.DecodeString(
+		strings.ReplaceAll(string(sigBody), "\r\n", ""))
+	assert.Nil(t, err)
+
+	p7, err := pkcs7.Parse(sig)
+	if err != nil {
+		panic(err)
+	}
+	p7.Content = entity
+	assert.Nil(t, p7.Verify())
+	assert.Equal(t, signer.Raw, p7.GetOnlySigner().Raw)
+	return entity
+}
+
+func TestSMIMESign(t *testing.T) {
+	signer, msg := sendSMIME(t, "Hello world!\n", nil)
+	header, _ := splitMessage(msg)
+	subject, _ := header.Subject()
+	assert.Equal(t, "Hello", subject)
+	assert.True(t, header.Has("Message-Id"))
+
+	entity := verifySigned(t, signer, msg)
+	assert.Contains(t, string(entity), "Content-Type: text/plain")
+	assert.Contains(t, string(entity), "Hello world!")
+}
+
+func TestSMIMEEncrypt(t *testing.T) {
+	rcpt, rcptKey := testCertificate("rms@example.org")
+	rcptPEM := string(certPEM(rcpt))
+	signer, msg := sendSMIME(t, "Hello world!\n", &rcptPEM)
+
+	header, body := splitMessage(msg)
+	contentType, params, err := header.ContentType()
+	assert.Nil(t, err)
+	assert.Equal(t, "application/pkcs7-mime", contentType)
+	assert.Equal(t, "enveloped-data", params["smime-type"])
+	subject, _ := header.Subject()
+	assert.Equal(t, "Hello", subject)
+
+	der, err := base64.StdEncoding.DecodeString(
+		strings.ReplaceAll(string(body), "\r\n", ""))
+	assert.Nil(t, err)
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		panic(err)
+	}
+	inner, err := p7.Decrypt(rcpt, rcptKey)
+	if err != nil {
+		panic(err)
+	}
+
+	// The decrypted message is the signed message
+	entity := verifySigned(t, signer, inner)
+	assert.Contains(t, string(entity), "Hello world!")
+
+	invalid := "not a certificate"
+	err = writeSMIME(ioutil.Discard, mail.Header{},
+		Body{Text: strings.NewReader("Hello")}, nil, &invalid)
+	assert.NotNil(t, err)
+
+	// The pkcs7 package's default algorithm is left alone for other users
+	assert.Equal(t, pkcs7.EncryptionAlgorithmDESCBC,
+		pkcs7.ContentEncryptionAlgorithm)
+}
+
+func TestSMIMECanonical(t *testing.T) {
+	signer, msg := sendSMIME(t, "Héllo wörld!\nTrailing space \n\n", nil)
+
+	// The signature is still valid if the line endings of the message are
+	// converted in transit
+	msg = bytes.ReplaceAll(msg, []byte("\r\n"), []byte("\n"))
+	msg = bytes.ReplaceAll(msg, []byte("\n"), []byte("\r\n"))
+	entity := verifySigned(t, signer, msg)
+
+	assert.NotContains(t, strings.ReplaceAll(string(entity), "\r\n", ""), "\n")
+	for _, c := range entity {
+		if c >= 0x80 {
+			t.Fatalf("Signed entity contains 8-bit data")
+		}
+	}
+	assert.Contains(t, string(entity), "Content-Transfer-Encoding: quoted-printable")
+	assert.Contains(t, string(entity), "H=C3=A9llo w=C3=B6rld!")
+}
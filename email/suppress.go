@@ -0,0 +1,276 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/emersion/go-message/mail"
+	"github.com/go-chi/chi"
+	"github.com/lib/pq"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/crypto"
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+// If [mail]suppression-list is set to "yes", mail is not sent to addresses
+// on the service's suppression list, which must have the following schema:
+//
+//	CREATE TABLE email_suppression (
+//		id serial PRIMARY KEY,
+//		created timestamp without time zone NOT NULL,
+//		address varchar NOT NULL,
+//		list varchar NOT NULL DEFAULT '',
+//		reason varchar NOT NULL,
+//		UNIQUE (address, list)
+//	);
+//
+// An empty list suppresses all mail to the address, as is the case for
+// addresses which bounced. Otherwise, the address only stops receiving bulk
+// mail for that list, which senders identify with the List-Id header
+// (RFC 2919), e.g.:
+//
+//	List-Id: Ticket notifications <tickets.todo.sr.ht>
+//
+// Such mail is given RFC 8058 one-click List-Unsubscribe headers, which link
+// to the handler returned by UnsubscribeHandler. The server mounts it at
+// /query/unsubscribe/{token}.
+const (
+	SuppressBounce      = "bounce"
+	SuppressUnsubscribe = "unsubscribe"
+)
+
+func loadSuppression(conf ini.File) bool {
+	v, ok := conf.Get("mail", "suppression-list")
+	if !ok {
+		return false
+	}
+	switch v {
+	case "yes":
+		return true
+	case "no":
+		return false
+	default:
+		panic(fmt.Errorf("Unable to parse [mail]suppression-list (must be yes or no)"))
+	}
+}
+
+// Returns the list identifier from the List-Id header, e.g.
+// "tickets.todo.sr.ht", or an empty string if the message is not bulk mail.
+func listID(header mail.Header) string {
+	id := header.Get("List-Id")
+	if i := strings.LastIndexByte(id, '<'); i != -1 {
+		id = id[i+1:]
+		if j := strings.IndexByte(id, '>'); j != -1 {
+			id = id[:j]
+		}
+	}
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// Adds an address to the suppression list. If list is empty, no mail will be
+// sent to the address; otherwise it will not receive bulk mail for that list.
+func Suppress(ctx context.Context, address, list, reason string) error {
+	return database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		_, err := sq.
+			Insert("email_suppression").
+			Columns("created", "address", "list", "reason").
+			Values(sq.Expr("NOW() at time zone 'utc'"),
+				strings.ToLower(address), list, reason).
+			Suffix(`ON CONFLICT (address, list) DO NOTHING`).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ExecContext(ctx)
+		return err
+	})
+}
+
+// Removes an address from the suppression list for the given list, or the
+// list of addresses which receive no mail at all if list is empty.
+func Unsuppress(ctx context.Context, address, list string) error {
+	return database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		_, err := sq.
+			Delete("email_suppression").
+			Where(sq.Eq{
+				"address": strings.ToLower(address),
+				"list":    list,
+			}).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ExecContext(ctx)
+		return err
+	})
+}
+
+// Returns the recipients who are not suppressed for the given list.
+func filterSuppressed(ctx context.Context, rcpts []string, list string) ([]string, error) {
+	addresses := make(pq.StringArray, len(rcpts))
+	for i, rcpt := range rcpts {
+		addresses[i] = strings.ToLower(rcpt)
+	}
+
+	suppressed := make(map[string]struct{})
+	err := database.WithTx(ctx, &sql.TxOptions{
+		Isolation: 0,
+		ReadOnly:  true,
+	}, func(tx *sql.Tx) error {
+		rows, err := sq.
+			Select("address").
+			From("email_suppression").
+			Where("address = ANY(?)", addresses).
+			Where(sq.Or{sq.Eq{"list": ""}, sq.Eq{"list": list}}).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var address string
+			if err := rows.Scan(&address); err != nil {
+				return err
+			}
+			suppressed[address] = struct{}{}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var allowed []string
+	for _, rcpt := range rcpts {
+		if _, ok := suppressed[strings.ToLower(rcpt)]; ok {
+			log.Printf("Not sending mail to suppressed address %s", rcpt)
+			continue
+		}
+		allowed = append(allowed, rcpt)
+	}
+	return allowed, nil
+}
+
+type unsubscribeToken struct {
+	Address string `json:"a"`
+	List    string `json:"l"`
+}
+
+// Returns a signed token which unsubscribes an address from a list.
+func newUnsubscribeToken(address, list string) string {
+	payload, err := json.Marshal(&unsubscribeToken{
+		Address: strings.ToLower(address),
+		List:    list,
+	})
+	if err != nil {
+		panic(err)
+	}
+	mac := crypto.BearerHMAC(append([]byte("unsubscribe:"), payload...))
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac)
+}
+
+func verifyUnsubscribeToken(token string) (*unsubscribeToken, error) {
+	invalid := errors.New("invalid unsubscribe token")
+	parts := strings.Split(token, ".")
+	if len(parts) != 2 {
+		return nil, invalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, invalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, invalid
+	}
+	if !crypto.BearerVerify(append([]byte("unsubscribe:"), payload...), mac) {
+		return nil, invalid
+	}
+	var t unsubscribeToken
+	if err := json.Unmarshal(payload, &t); err != nil || t.List == "" {
+		return nil, invalid
+	}
+	return &t, nil
+}
+
+// Returns the List-Unsubscribe header fields for a recipient of bulk mail.
+func listUnsubscribeHeader(ctx context.Context, rcpt, list string) []byte {
+	origin := config.GetOrigin(config.ForContext(ctx),
+		config.ServiceName(ctx), true)
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "List-Unsubscribe: <%s/query/unsubscribe/%s>\r\n",
+		origin, newUnsubscribeToken(rcpt, list))
+	buf.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	return buf.Bytes()
+}
+
+var unsubscribeTemplate = template.Must(template.New("unsubscribe").Parse(`<!doctype html>
+<html>
+<head><title>Unsubscribe</title></head>
+<body>
+{{if .Done -}}
+<p>{{.Address}} has been unsubscribed from {{.List}}.</p>
+{{- else -}}
+<form method="POST">
+<p>Unsubscribe {{.Address}} from {{.List}}?</p>
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button type="submit">Unsubscribe</button>
+</form>
+{{- end}}
+</body>
+</html>
+`))
+
+// Returns an HTTP handler for the unsubscribe links in bulk mail, which
+// expects the token as the "token" URL parameter. A POST request unsubscribes
+// the recipient, as specified by RFC 8058, and a GET request shows a form to
+// confirm, so that link scanners do not unsubscribe recipients.
+func UnsubscribeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := verifyUnsubscribeToken(chi.URLParam(r, "token"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		data := struct {
+			Address string
+			List    string
+			Done    bool
+		}{token.Address, token.List, false}
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			err := Suppress(r.Context(), token.Address,
+				token.List, SuppressUnsubscribe)
+			if err != nil {
+				log.Printf("Unable to unsubscribe %s from %s: %v",
+					token.Address, token.List, err)
+				http.Error(w, "Internal server error",
+					http.StatusInternalServerError)
+				return
+			}
+			data.Done = true
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := unsubscribeTemplate.Execute(w, &data); err != nil {
+			log.Printf("Unable to render unsubscribe page: %v", err)
+		}
+	})
+}
@@ -0,0 +1,162 @@
+package email
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/emersion/go-message/mail"
+	"github.com/go-chi/chi"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/crypto"
+	"git.sr.ht/~sircmpwn/core-go/database"
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+)
+
+func init() {
+	conf, err := ini.Load(strings.NewReader(`
+[webhooks]
+private-key=ebzsjPaN6E13ln/FeNWly1C92q6bVMVdOnDo1HPl5fc=
+
+[sr.ht]
+network-key=tbuG-7Vh44vrDq1L_HKWkHnWrDOtJhEkPKPiauaLeuk=`))
+	if err != nil {
+		panic(err)
+	}
+	crypto.InitCrypto(conf)
+}
+
+func TestSuppression(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	maildir := filepath.Join(t.TempDir(), "maildir")
+	ctx := transportContext("transport=maildir\nmaildir=" + maildir +
+		"\nsuppression-list=yes\n[test]\norigin=https://test.example.org")
+	ctx = database.Context(ctx, db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT address FROM email_suppression WHERE address = ANY\(\$1\) AND \(list = \$2 OR list = \$3\)`).
+		WithArgs(sqlmock.AnyArg(), "", "tickets.todo.sr.ht").
+		WillReturnRows(sqlmock.NewRows([]string{"address"}).
+			AddRow("unsubscribed@example.org"))
+	mock.ExpectCommit()
+
+	var header mail.Header
+	header.SetSubject("Ticket updated")
+	header.Set("List-Id", "Ticket notifications <tickets.todo.sr.ht>")
+	header.SetAddressList("To", []*mail.Address{
+		{Address: "rms@example.org"},
+		{Address: "Unsubscribed@example.org"},
+		{Address: "jdoe@example.org"},
+	})
+	assert.Nil(t, EnqueueStd(ctx, header, strings.NewReader("Hello!"), nil))
+	ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Each recipient receives a link to unsubscribe themselves
+	var rcpts []string
+	for _, msg := range emailtest.Maildir(t, maildir) {
+		mr, err := mail.CreateReader(strings.NewReader(msg))
+		if err != nil {
+			panic(err)
+		}
+		assert.Equal(t, "List-Unsubscribe=One-Click",
+			mr.Header.Get("List-Unsubscribe-Post"))
+		link := strings.Trim(mr.Header.Get("List-Unsubscribe"), "<>")
+		prefix := "https://test.example.org/query/unsubscribe/"
+		if !assert.True(t, strings.HasPrefix(link, prefix), link) {
+			continue
+		}
+		token, err := verifyUnsubscribeToken(strings.TrimPrefix(link, prefix))
+		if assert.Nil(t, err) {
+			assert.Equal(t, "tickets.todo.sr.ht", token.List)
+			rcpts = append(rcpts, token.Address)
+		}
+	}
+	assert.ElementsMatch(t, []string{"rms@example.org", "jdoe@example.org"}, rcpts)
+}
+
+func TestUnsubscribeHandler(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	router := chi.NewRouter()
+	router.Use(database.Middleware(db))
+	router.Handle("/query/unsubscribe/{token}", UnsubscribeHandler())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	token := newUnsubscribeToken("RMS@example.org", "tickets.todo.sr.ht")
+	link := srv.URL + "/query/unsubscribe/" + token
+
+	// GET only shows a confirmation form
+	resp, err := http.Get(link)
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `<form method="POST">`)
+	assert.Contains(t, string(body), "rms@example.org")
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO email_suppression \(created,address,list,reason\) VALUES \(NOW\(\) at time zone 'utc',\$1,\$2,\$3\) ON CONFLICT \(address, list\) DO NOTHING`).
+		WithArgs("rms@example.org", "tickets.todo.sr.ht", SuppressUnsubscribe).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	resp, err = http.PostForm(link, url.Values{
+		"List-Unsubscribe": []string{"One-Click"},
+	})
+	assert.Nil(t, err)
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), "has been unsubscribed")
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Tokens cannot be forged
+	forged := strings.Split(newUnsubscribeToken("jdoe@example.org", "x"), ".")[0] +
+		"." + strings.Split(token, ".")[1]
+	for _, token := range []string{forged, "garbage", ""} {
+		resp, err = http.PostForm(srv.URL+"/query/unsubscribe/"+token, nil)
+		assert.Nil(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	}
+}
+
+func TestSuppressBounces(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx, _ := testServer(t, "suppression-list=yes")
+	ctx = database.Context(ctx, db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT address FROM email_suppression`).
+		WithArgs(sqlmock.AnyArg(), "", "").
+		WillReturnRows(sqlmock.NewRows([]string{"address"}))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO email_suppression`).
+		WithArgs("unknown@example.org", "", SuppressBounce).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	var header mail.Header
+	header.SetSubject("Hello")
+	header.SetAddressList("To", []*mail.Address{{Address: "unknown@example.org"}})
+	assert.Nil(t, EnqueueStd(ctx, header, strings.NewReader("Hello!"), nil))
+	ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,209 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+)
+
+// Emails may be rendered from named templates, which are loaded from the
+// directory given by [mail]templates, falling back to the defaults embedded
+// in this package. A template consists of the following files:
+//
+//	{name}.txt  - the plain text body, which is required
+//	{name}.html - an HTML alternative, which is optional
+//
+// Localized variants are named e.g. {name}.pt-BR.txt. For a locale such as
+// "pt-BR", the "pt-BR", "pt", and unlocalized templates are tried in that
+// order. The text template may define a "subject" template, which is used as
+// the subject of the email if the header does not already have one.
+//
+//go:embed templates
+var defaultTemplates embed.FS
+
+// The data passed to email templates.
+type TemplateData struct {
+	Site Site
+	// The data provided by the sender
+	Data interface{}
+}
+
+// Information about this SourceHut instance, from the config.
+type Site struct {
+	Name       string
+	OwnerName  string
+	OwnerEmail string
+	// The name of the service sending the email, e.g. "meta.sr.ht", and its
+	// origin
+	Service string
+	Origin  string
+	// The origin of each service, by name
+	Origins map[string]string
+}
+
+type templateSet struct {
+	text map[string]*texttemplate.Template
+	html map[string]*htmltemplate.Template
+}
+
+// Loads the embedded templates, followed by the templates from the configured
+// directory, which take precedence.
+func loadTemplates(conf ini.File) *templateSet {
+	ts := &templateSet{
+		text: make(map[string]*texttemplate.Template),
+		html: make(map[string]*htmltemplate.Template),
+	}
+	embedded, err := fs.Sub(defaultTemplates, "templates")
+	if err != nil {
+		panic(err)
+	}
+	if err := ts.load(embedded); err != nil {
+		panic(err)
+	}
+	if dir, ok := conf.Get("mail", "templates"); ok {
+		if err := ts.load(os.DirFS(dir)); err != nil {
+			panic(fmt.Errorf("Unable to load [mail]templates: %v", err))
+		}
+	}
+	return ts
+}
+
+func (ts *templateSet) load(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		src, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		name := path.Base(p)
+		switch path.Ext(name) {
+		case ".txt":
+			key := strings.TrimSuffix(name, ".txt")
+			tmpl, err := texttemplate.New(name).Parse(string(src))
+			if err != nil {
+				return err
+			}
+			ts.text[key] = tmpl
+		case ".html":
+			key := strings.TrimSuffix(name, ".html")
+			tmpl, err := htmltemplate.New(name).Parse(string(src))
+			if err != nil {
+				return err
+			}
+			ts.html[key] = tmpl
+		}
+		return nil
+	})
+}
+
+// Returns the templates for the given name and locale, applying the locale
+// fallback rules. The HTML template is nil if there is none.
+func (ts *templateSet) lookup(name, locale string) (*texttemplate.Template,
+	*htmltemplate.Template, error) {
+	var candidates []string
+	if locale != "" {
+		candidates = append(candidates, name+"."+locale)
+		if i := strings.IndexAny(locale, "-_"); i != -1 {
+			candidates = append(candidates, name+"."+locale[:i])
+		}
+	}
+	candidates = append(candidates, name)
+	for _, key := range candidates {
+		if text, ok := ts.text[key]; ok {
+			return text, ts.html[key], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("No such email template %q", name)
+}
+
+func siteInfo(ctx context.Context, conf ini.File) Site {
+	site := Site{
+		Service: config.ServiceName(ctx),
+		Origins: make(map[string]string),
+	}
+	site.Name, _ = conf.Get("sr.ht", "site-name")
+	site.OwnerName, _ = conf.Get("sr.ht", "owner-name")
+	site.OwnerEmail, _ = conf.Get("sr.ht", "owner-email")
+	for svc, section := range conf {
+		if _, ok := section["origin"]; ok && !strings.Contains(svc, "::") {
+			site.Origins[svc] = config.GetOrigin(conf, svc, true)
+		}
+	}
+	site.Origin = site.Origins[site.Service]
+	return site
+}
+
+// Renders the named template with the given data, and queues the email for
+// delivery as with EnqueueStd. The locale is that of the recipient, e.g.
+// "pt-BR", or an empty string to use the unlocalized template.
+func EnqueueTemplate(ctx context.Context, header mail.Header,
+	name, locale string, data interface{}, rcptKey *string) error {
+	body, err := renderTemplate(ctx, &header, name, locale, data)
+	if err != nil {
+		return err
+	}
+	return EnqueueMultipart(ctx, header, body, rcptKey)
+}
+
+// Like EnqueueTemplate, but the email is a notification which is subject to
+// the per-recipient rate limit, as with EnqueueNotification.
+func EnqueueTemplateNotification(ctx context.Context, header mail.Header,
+	name, locale string, data interface{}, rcptKey *string) error {
+	body, err := renderTemplate(ctx, &header, name, locale, data)
+	if err != nil {
+		return err
+	}
+	return enqueueNotification(ctx, header, body, rcptKey)
+}
+
+// Renders the named template, setting the subject on the header unless it
+// already has one.
+func renderTemplate(ctx context.Context, header *mail.Header,
+	name, locale string, data interface{}) (Body, error) {
+	queue := ForContext(ctx)
+	text, html, err := queue.templates.lookup(name, locale)
+	if err != nil {
+		return Body{}, err
+	}
+
+	td := TemplateData{
+		Site: siteInfo(ctx, config.ForContext(ctx)),
+		Data: data,
+	}
+	if subject := text.Lookup("subject"); subject != nil && !header.Has("Subject") {
+		var buf bytes.Buffer
+		if err := subject.Execute(&buf, &td); err != nil {
+			return Body{}, err
+		}
+		header.SetSubject(strings.TrimSpace(buf.String()))
+	}
+
+	var body Body
+	var textBuf bytes.Buffer
+	if err := text.Execute(&textBuf, &td); err != nil {
+		return Body{}, err
+	}
+	body.Text = &textBuf
+	if html != nil {
+		var htmlBuf bytes.Buffer
+		if err := html.Execute(&htmlBuf, &td); err != nil {
+			return Body{}, err
+		}
+		body.HTML = &htmlBuf
+	}
+	return body, nil
+}
@@ -0,0 +1,98 @@
+package email
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+)
+
+// Enqueues a templated email and returns the delivered message.
+func sendTemplate(t *testing.T, options, name, locale string,
+	data interface{}) (*mail.Reader, []testPart) {
+	maildir := filepath.Join(t.TempDir(), "maildir")
+	ctx := transportContext("transport=maildir\nmaildir=" + maildir +
+		"\n" + options + `
+
+[test.sr.ht]
+origin=https://test.example.org
+
+[meta.sr.ht]
+origin=https://meta.example.org`)
+
+	var header mail.Header
+	header.SetAddressList("To", []*mail.Address{{Address: "rms@example.org"}})
+	assert.Nil(t, EnqueueTemplate(ctx, header, name, locale, data, nil))
+	ForContext(ctx).Queue.Dispatch(ctx)
+
+	msgs := emailtest.Maildir(t, maildir)
+	if len(msgs) != 1 {
+		t.Fatalf("Expected one message, got %d", len(msgs))
+	}
+	return readParts(t, strings.NewReader(msgs[0]))
+}
+
+func TestDefaultTemplate(t *testing.T) {
+	mr, parts := sendTemplate(t, "", "graphql-error", "", map[string]interface{}{
+		"Error": errors.New("oh no"),
+		"Stack": "goroutine 1 [running]:",
+	})
+	subject, _ := mr.Header.Subject()
+	assert.Equal(t, "[test] GraphQL query error: oh no", subject)
+	assert.Equal(t, []testPart{{"text/plain", "",
+		"An error occured outside of the GraphQL context:\r\n\r\n" +
+			"goroutine 1 [running]:\r\n"}}, parts)
+}
+
+func TestTemplateLocales(t *testing.T) {
+	dir := t.TempDir()
+	for name, src := range map[string]string{
+		"welcome.txt": `{{define "subject"}}Welcome to {{.Site.Name}}{{end -}}
+Hello {{.Data}}, see {{index .Site.Origins "meta.sr.ht"}}`,
+		"welcome.html":    `<p>Hello {{.Data}}, from {{.Site.OwnerName}}</p>`,
+		"welcome.pt.txt":  `Olá {{.Data}}`,
+		"welcome.fr.txt":  `Bonjour {{.Data}}`,
+		"welcome.fr.html": `<p>Bonjour {{.Data}}</p>`,
+	} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0600)
+		if err != nil {
+			panic(err)
+		}
+	}
+	options := "templates=" + dir + "\n[sr.ht]\nsite-name=sr.ht"
+
+	// The base template includes site info
+	mr, parts := sendTemplate(t, options, "welcome", "", "<rms>")
+	subject, _ := mr.Header.Subject()
+	assert.Equal(t, "Welcome to sr.ht", subject)
+	assert.Equal(t, []testPart{
+		{"text/plain", "", "Hello <rms>, see https://meta.example.org"},
+		{"text/html", "", "<p>Hello &lt;rms&gt;, from Jane Doe</p>"},
+	}, parts)
+
+	// Locales fall back to the language, without an HTML alternative
+	_, parts = sendTemplate(t, options, "welcome", "pt-BR", "rms")
+	assert.Equal(t, []testPart{{"text/plain", "", "Olá rms"}}, parts)
+
+	_, parts = sendTemplate(t, options, "welcome", "fr", "rms")
+	assert.Equal(t, []testPart{
+		{"text/plain", "", "Bonjour rms"},
+		{"text/html", "", "<p>Bonjour rms</p>"},
+	}, parts)
+
+	// Unknown locales use the base template
+	_, parts = sendTemplate(t, options, "welcome", "de-DE", "rms")
+	assert.True(t, strings.HasPrefix(parts[0].body, "Hello rms"))
+}
+
+func TestUnknownTemplate(t *testing.T) {
+	ctx := transportContext("")
+	err := EnqueueTemplate(ctx, mail.Header{}, "nonexistent", "", nil, nil)
+	assert.NotNil(t, err)
+}
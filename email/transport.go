@@ -0,0 +1,213 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/vaughan0/go-ini"
+)
+
+// Mail is delivered with the transport selected by [mail]transport:
+//
+//	smtp     - an SMTP relay configured by [mail]smtp-* (the default)
+//	sendmail - a local sendmail binary, [mail]sendmail (default /usr/sbin/sendmail)
+//	lmtp     - an LMTP server listening on the unix socket [mail]lmtp-socket
+//	maildir  - a maildir at [mail]maildir, e.g. for integration tests
+//	mbox     - an mbox file at [mail]mbox, e.g. for integration tests
+//
+// The envelope sender is chosen by the caller, see envelopeSender.
+type transport interface {
+	send(ctx context.Context, from string, msg []byte, rcpts []string) error
+}
+
+// Returns the transport selected by the config. If pooled is false, SMTP
+// connections are closed after each message.
+func newTransport(conf ini.File, pooled bool) transport {
+	name, _ := conf.Get("mail", "transport")
+	switch name {
+	case "", "smtp":
+		if !pooled {
+			return &connPool{}
+		}
+		return newConnPool(conf)
+	case "sendmail":
+		command, ok := conf.Get("mail", "sendmail")
+		if !ok {
+			command = "/usr/sbin/sendmail"
+		}
+		return &sendmailTransport{command: command}
+	case "lmtp":
+		socket, ok := conf.Get("mail", "lmtp-socket")
+		if !ok {
+			panic(fmt.Errorf("Missing LMTP configuration options [lmtp-socket]"))
+		}
+		return &lmtpTransport{socket: socket}
+	case "maildir":
+		dir, ok := conf.Get("mail", "maildir")
+		if !ok {
+			panic(fmt.Errorf("Missing maildir configuration options [maildir]"))
+		}
+		return &maildirTransport{dir: dir}
+	case "mbox":
+		path, ok := conf.Get("mail", "mbox")
+		if !ok {
+			panic(fmt.Errorf("Missing mbox configuration options [mbox]"))
+		}
+		return &mboxTransport{path: path}
+	default:
+		panic(fmt.Errorf("Invalid mail configuration value for [transport]"))
+	}
+}
+
+func mustSender(conf ini.File) string {
+	from, ok := conf.Get("mail", "smtp-from")
+	if !ok {
+		panic(fmt.Errorf("Missing mail configuration options [smtp-from]"))
+	}
+	sender, err := mail.ParseAddress(from)
+	if err != nil {
+		panic(err)
+	}
+	return sender.Address
+}
+
+type sendmailTransport struct {
+	command string
+}
+
+func (t *sendmailTransport) send(ctx context.Context,
+	from string, msg []byte, rcpts []string) error {
+	args := append([]string{"-i", "-f", from, "--"}, rcpts...)
+	cmd := exec.CommandContext(ctx, t.command, args...)
+	cmd.Stdin = bytes.NewReader(msg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %w: %s", t.command, err,
+			strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+type lmtpTransport struct {
+	socket string
+}
+
+func (t *lmtpTransport) send(ctx context.Context,
+	from string, msg []byte, rcpts []string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", t.socket)
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClientLMTP(conn, "localhost")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if err := c.Mail(from, nil); err != nil {
+		return err
+	}
+	rejected, err := addRecipients(c, rcpts)
+	if err != nil {
+		return err
+	}
+	w, err := c.LMTPData(nil)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := c.Quit(); err != nil {
+		return err
+	}
+	if len(rejected) != 0 {
+		return rejected
+	}
+	return nil
+}
+
+type maildirTransport struct {
+	dir string
+}
+
+var maildirSeq uint64
+
+func (t *maildirTransport) send(ctx context.Context,
+	from string, msg []byte, rcpts []string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000,
+		os.Getpid(), atomic.AddUint64(&maildirSeq, 1),
+		strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname))
+
+	tmp := filepath.Join(t.dir, "tmp", name)
+	if err := os.WriteFile(tmp, msg, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(t.dir, "new", name))
+}
+
+type mboxTransport struct {
+	mutex sync.Mutex
+	path  string
+}
+
+func (t *mboxTransport) send(ctx context.Context,
+	from string, msg []byte, rcpts []string) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", from,
+		time.Now().UTC().Format(time.ANSIC))
+	lines := strings.SplitAfter(
+		strings.ReplaceAll(string(msg), "\r\n", "\n"), "\n")
+	for _, line := range lines {
+		// mboxrd quoting
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			buf.WriteString(">")
+		}
+		buf.WriteString(line)
+	}
+	if !bytes.HasSuffix(buf.Bytes(), []byte("\n")) {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	f, err := os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
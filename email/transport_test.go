@@ -0,0 +1,117 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+)
+
+func transportContext(options string) context.Context {
+	conf, err := ini.Load(strings.NewReader(`
+[sr.ht]
+owner-name=Jane Doe
+owner-email=jdoe@example.org
+
+[mail]
+smtp-from=test@example.org
+` + options))
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), conf, "test")
+	return Context(ctx, NewQueue(conf))
+}
+
+func TestMaildirTransport(t *testing.T) {
+	dir := t.TempDir()
+	ctx := transportContext("transport=maildir\nmaildir=" + dir)
+
+	var header mail.Header
+	header.SetSubject("Hello")
+	header.SetAddressList("To", []*mail.Address{{Address: "rms@example.org"}})
+	err := EnqueueStd(ctx, header, strings.NewReader("Hello world!"), nil)
+	assert.Nil(t, err)
+	ForContext(ctx).Queue.Dispatch(ctx)
+
+	msgs := emailtest.Maildir(t, dir)
+	if assert.Len(t, msgs, 1) {
+		assert.Contains(t, msgs[0], "Subject: Hello\r\n")
+		assert.Contains(t, msgs[0], "To: <rms@example.org>\r\n")
+		assert.Contains(t, msgs[0], "Hello world!")
+	}
+}
+
+func TestMboxTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mbox")
+	ctx := transportContext("transport=mbox\nmbox=" + path)
+
+	rcpts := []string{"rms@example.org"}
+	assert.Nil(t, Send(ctx, bytes.NewBufferString(
+		"Subject: 1\r\n\r\nFrom here\r\n>From there\r\n"), rcpts))
+	assert.Nil(t, Send(ctx, bytes.NewBufferString(
+		"Subject: 2\r\n\r\nHello"), rcpts))
+
+	b, err := ioutil.ReadFile(path)
+	assert.Nil(t, err)
+	parts := strings.Split(string(b), "\n\nFrom test@example.org ")
+	assert.Len(t, parts, 2)
+	assert.True(t, strings.HasPrefix(parts[0], "From test@example.org "))
+	assert.True(t, strings.HasSuffix(parts[0], "\n\n>From here\n>>From there"))
+	assert.True(t, strings.HasSuffix(parts[1], "\n\nHello\n\n"))
+}
+
+func TestSendmailTransport(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out")
+	script := filepath.Join(dir, "sendmail")
+	err := os.WriteFile(script, []byte(fmt.Sprintf(
+		"#!/bin/sh\necho \"$@\" > %[1]s\ncat >> %[1]s\n", out)), 0700)
+	if err != nil {
+		panic(err)
+	}
+	ctx := transportContext("transport=sendmail\nsendmail=" + script)
+
+	assert.Nil(t, Send(ctx, bytes.NewBufferString("Subject: Hello\r\n\r\nHi"),
+		[]string{"rms@example.org", "jdoe@example.org"}))
+	b, err := ioutil.ReadFile(out)
+	assert.Nil(t, err)
+	assert.Equal(t, "-i -f test@example.org -- rms@example.org jdoe@example.org\n"+
+		"Subject: Hello\r\n\r\nHi", string(b))
+}
+
+func TestLMTPTransport(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "lmtp")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		panic(err)
+	}
+	be := &testBackend{}
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	srv.LMTP = true
+	go srv.Serve(l)
+	defer srv.Close()
+
+	ctx := transportContext("transport=lmtp\nlmtp-socket=" + socket)
+	assert.Nil(t, Send(ctx, bytes.NewBufferString("Subject: Hello\r\n\r\nHi\r\n"),
+		[]string{"rms@example.org"}))
+	assert.Equal(t, []string{"Subject: Hello\r\n\r\nHi\r\n"}, be.messages)
+
+	err = Send(ctx, bytes.NewBufferString("Subject: Hello\r\n\r\nHi\r\n"),
+		[]string{"unknown@example.org"})
+	assert.NotNil(t, err)
+}
@@ -14,6 +14,7 @@ import (
 	work "git.sr.ht/~sircmpwn/dowork"
 	_ "github.com/emersion/go-message/charset"
 	"github.com/emersion/go-message/mail"
+	"github.com/emersion/go-msgauth/dkim"
 	"github.com/vaughan0/go-ini"
 )
 
@@ -26,20 +27,56 @@ type contextKey struct {
 // Returns a task which will send this email for the work queue. If the caller
 // does not need to customize the task parameters, the Enqueue function may be
 // more desirable.
+//
+// Transient errors are retried, but permanent errors (see IsPermanent) are
+// not. Either way, undeliverable mail is reported to the function registered
+// with OnFailure. Recipients which the server rejects individually are
+// reported one at a time, and the message is still delivered to the others.
 func NewTask(msg *bytes.Buffer, rcpts []string) *work.Task {
-	return work.NewTask(func(ctx context.Context) error {
-		err := Send(ctx, msg, rcpts)
-		if err != nil {
-			log.Printf("Error sending mail: %v", err)
+	var (
+		lastErr  error
+		reported bool
+		task     *work.Task
+	)
+	task = work.NewTask(func(ctx context.Context) error {
+		// The buffer is not consumed, so that each attempt sends the whole
+		// message
+		err := Send(ctx, bytes.NewReader(msg.Bytes()), rcpts)
+		if err == nil {
+			return nil
+		}
+		var rejected RejectedRecipients
+		if errors.As(err, &rejected) {
+			// The message was delivered to the other recipients, so only the
+			// rejected recipients are reported
+			for _, rerr := range rejected {
+				log.Printf("Mail to %s rejected: %v", rerr.Recipient, rerr.Err)
+				reportFailure(ctx, msg.Bytes(), []string{rerr.Recipient},
+					rerr.Err, task.Attempts(), true)
+			}
+			return nil
+		}
+		lastErr = err
+		log.Printf("Error sending mail: %v", err)
+		if IsPermanent(err) {
+			// dowork does not call After until the task has used up its
+			// remaining attempts, so the failure is reported right away
+			reportFailure(ctx, msg.Bytes(), rcpts, err, task.Attempts(), true)
+			reported = true
+			return fmt.Errorf("%w: %v", work.ErrDoNotReattempt, err)
 		}
 		return err
-	}).Retries(10).After(func(ctx context.Context, task *work.Task) {
+	})
+	return task.Retries(10).After(func(ctx context.Context, task *work.Task) {
 		if task.Result() == nil {
 			log.Printf("Mail to %s sent after %d attempts",
 				strings.Join(rcpts, ", "), task.Attempts())
-		} else {
+		} else if !reported {
+			// The final attempt only reports that the retries are exhausted
+			attempts := task.Attempts() - 1
 			log.Printf("Mail to %s failed after %d attempts: %v",
-				strings.Join(rcpts, ", "), task.Attempts(), task.Result())
+				strings.Join(rcpts, ", "), attempts, lastErr)
+			reportFailure(ctx, msg.Bytes(), rcpts, lastErr, attempts, false)
 		}
 	})
 }
@@ -49,8 +86,18 @@ func NewTask(msg *bytes.Buffer, rcpts []string) *work.Task {
 // Senders should fill in at least the To and Subject headers, and the message
 // body. Message-ID, Date, From, and Reply-To will also be added if they are not
 // already present.
+//
+// If rcptKey is not nil, it shall be the recipient's PEM-encoded S/MIME
+// certificate, and the message is encrypted to it. See smime.go.
 func EnqueueStd(ctx context.Context, header mail.Header,
 	bodyReader io.Reader, rcptKey *string) error {
+	return EnqueueMultipart(ctx, header, Body{Text: bodyReader}, rcptKey)
+}
+
+// Like EnqueueStd, but the message may include an HTML alternative and
+// attachments. See Body.
+func EnqueueMultipart(ctx context.Context, header mail.Header,
+	body Body, rcptKey *string) error {
 
 	queue := ForContext(ctx)
 
@@ -89,29 +136,74 @@ func EnqueueStd(ctx context.Context, header mail.Header,
 		header.SetAddressList("Reply-To", []*mail.Address{queue.ownerAddress})
 	}
 
-	var (
-		buf       bytes.Buffer
-	)
+	list := listID(header)
+	if queue.suppression {
+		rcpts, err = filterSuppressed(ctx, rcpts, list)
+		if err != nil {
+			return err
+		}
+		if len(rcpts) == 0 {
+			return nil
+		}
+	}
 
-	header.SetContentType("text/plain", nil)
-	body, err := mail.CreateSingleInlineWriter(&buf, header)
+	var buf bytes.Buffer
+	if queue.smime == nil && rcptKey == nil {
+		err = writeMessage(&buf, header, body)
+	} else {
+		err = writeSMIME(&buf, header, body, queue.smime, rcptKey)
+	}
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer body.Close()
 
-	_, err = io.Copy(body, bodyReader)
-	if err != nil {
-		log.Fatal(err)
+	if queue.suppression && list != "" {
+		// Each recipient needs their own unsubscribe link
+		for _, rcpt := range rcpts {
+			msg := bytes.NewBuffer(listUnsubscribeHeader(ctx, rcpt, list))
+			msg.Write(buf.Bytes())
+			if err := queue.enqueue(msg, []string{rcpt}); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
+	if queue.bounceAddress != "" {
+		// Each recipient needs their own VERP envelope sender
+		for _, rcpt := range rcpts {
+			if err := queue.enqueue(&buf, []string{rcpt}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return queue.enqueue(&buf, rcpts)
+}
 
-	return queue.Enqueue(NewTask(&buf, rcpts))
+// Signs a message with DKIM, if configured, and queues it for delivery.
+func (queue *Queue) enqueue(msg *bytes.Buffer, rcpts []string) error {
+	if queue.dkim != nil {
+		var err error
+		if msg, err = signDKIM(msg, queue.dkim); err != nil {
+			return err
+		}
+	}
+	return queue.Enqueue(NewTask(msg, rcpts))
 }
 
 type Queue struct {
 	*work.Queue
 	smtpFrom     *mail.Address
 	ownerAddress *mail.Address
+	transport    transport
+	smime        *smimeSigner
+	dkim         *dkim.SignOptions
+	templates    *templateSet
+
+	bounceAddress string
+	rateLimit     *rateLimit
+	suppression   bool
+	onFailure     func(ctx context.Context, failure *DeliveryFailure)
 }
 
 // Creates a new email processing queue.
@@ -141,6 +233,14 @@ func NewQueue(conf ini.File) *Queue {
 		Queue:        work.NewQueue("email"),
 		smtpFrom:     addr,
 		ownerAddress: ownerAddr,
+		transport:    newTransport(conf, true),
+		smime:        loadSMIMESigner(conf),
+		dkim:         loadDKIMOptions(conf),
+		templates:    loadTemplates(conf),
+
+		bounceAddress: bounceAddress(conf),
+		rateLimit:     loadRateLimit(conf),
+		suppression:   loadSuppression(conf),
 	}
 }
 
@@ -34,3 +34,10 @@ func ForContext(ctx context.Context) *redis.Client {
 	}
 	return raw
 }
+
+// Like ForContext, but returns false rather than panicking if the context has
+// no Redis client.
+func TryForContext(ctx context.Context) (*redis.Client, bool) {
+	raw, ok := ctx.Value(redisCtxKey).(*redis.Client)
+	return raw, ok
+}
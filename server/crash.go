@@ -0,0 +1,292 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"time"
+
+	work "git.sr.ht/~sircmpwn/dowork"
+	"github.com/emersion/go-message/mail"
+	goRedis "github.com/go-redis/redis/v8"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/email"
+	"git.sr.ht/~sircmpwn/core-go/redis"
+)
+
+// Panics reported by EmailRecover are identified by a fingerprint of the
+// error and the stack, so that a bug in a hot code path does not flood the
+// administrator's inbox. The first occurrence of each panic is emailed right
+// away, and further occurrences are counted in Redis and emailed as a
+// periodic summary, configured with:
+//
+//	[mail]
+//	error-summary-interval  time between summaries (default 1h)
+//
+// The interval is read when the server is created. Panics are forgotten if
+// they do not re-occur for a week. If Redis is not available, every panic is
+// emailed right away.
+//
+// Each occurrence may also be forwarded to an error tracker, which receives a
+// crashReport as JSON in a POST request:
+//
+//	[sr.ht]
+//	error-tracker           URL of the error tracker
+//	error-tracker-token     bearer token for the error tracker (optional)
+const (
+	defaultCrashSummaryInterval = time.Hour
+	crashExpiry                 = 7 * 24 * time.Hour
+)
+
+var (
+	errNoCrashStore = errors.New("crash summaries require Redis")
+
+	crashTrackerClient = &http.Client{Timeout: 10 * time.Second}
+	// Numbers and addresses vary between occurrences of the same error
+	crashNormalizer = regexp.MustCompile(`0x[0-9a-fA-F]+|[0-9]+`)
+)
+
+type graphQLRequest struct {
+	Username  string `json:"username"`
+	Email     string `json:"email"`
+	Query     string `json:"query"`
+	Variables string `json:"variables"`
+}
+
+type crashReport struct {
+	Service     string          `json:"service"`
+	Fingerprint string          `json:"fingerprint"`
+	Error       string          `json:"error"`
+	Stack       string          `json:"stack"`
+	Timestamp   time.Time       `json:"timestamp"`
+	Request     *graphQLRequest `json:"request"`
+}
+
+// A panic which re-occurred since it was last reported.
+type crashSummary struct {
+	Fingerprint string
+	Error       string
+	Occurrences int64
+	Total       int64
+	First       time.Time
+	Last        time.Time
+}
+
+// Returns the fingerprint of an error which occured at the given call stack.
+// Only the function names are used, and not the line numbers, so that
+// deploying unrelated changes does not reset the deduplication.
+func crashFingerprint(err error, pcs []uintptr) string {
+	h := sha256.New()
+	h.Write(crashNormalizer.ReplaceAll([]byte(err.Error()), []byte("N")))
+	frames := runtime.CallersFrames(pcs)
+	for {
+		frame, more := frames.Next()
+		fmt.Fprintf(h, "\n%s", frame.Function)
+		if !more {
+			break
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+func crashKey(ctx context.Context, name string) string {
+	return fmt.Sprintf("crash:%s:%s", config.ServiceName(ctx), name)
+}
+
+// Counts an occurrence of a panic, and returns true if it is the first, or if
+// occurrences cannot be counted because Redis is not available.
+func recordCrash(ctx context.Context, report *crashReport) (bool, error) {
+	rc, ok := redis.TryForContext(ctx)
+	if !ok {
+		return true, nil
+	}
+	key := crashKey(ctx, report.Fingerprint)
+	now := strconv.FormatInt(report.Timestamp.Unix(), 10)
+
+	var total *goRedis.IntCmd
+	_, err := rc.TxPipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		total = pipe.HIncrBy(ctx, key, "total", 1)
+		pipe.HSetNX(ctx, key, "error", report.Error)
+		pipe.HSetNX(ctx, key, "first", now)
+		pipe.HSet(ctx, key, "last", now)
+		pipe.Expire(ctx, key, crashExpiry)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if total.Val() == 1 {
+		return true, nil
+	}
+
+	_, err = rc.TxPipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		pipe.HIncrBy(ctx, key, "pending", 1)
+		pipe.SAdd(ctx, crashKey(ctx, "pending"), report.Fingerprint)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return false, scheduleCrashSummary(ctx)
+}
+
+// Returns the configured interval between summaries. This panics if the
+// interval is invalid, and so is called when the server is created rather than
+// while recovering from a panic.
+func loadCrashSummaryInterval(conf ini.File) time.Duration {
+	v, ok := conf.Get("mail", "error-summary-interval")
+	if !ok {
+		return defaultCrashSummaryInterval
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		panic(fmt.Errorf("Unable to parse [mail]error-summary-interval (must be a positive duration)"))
+	}
+	return d
+}
+
+// Schedules the next summary, if it has not been already.
+func scheduleCrashSummary(ctx context.Context) error {
+	rc, ok := redis.TryForContext(ctx)
+	if !ok {
+		return errNoCrashStore
+	}
+	interval := defaultCrashSummaryInterval
+	if srv, ok := ctx.Value(serverCtxKey).(*Server); ok && srv.crashSummaryInterval != 0 {
+		interval = srv.crashSummaryInterval
+	}
+
+	// The marker expires in case the instance which scheduled the summary
+	// goes away before sending it
+	due := time.Now().Add(interval)
+	scheduled, err := rc.SetNX(ctx,
+		crashKey(ctx, "summary-due"), due.UTC().Format(time.RFC3339),
+		2*interval).Result()
+	if err != nil || !scheduled {
+		return err
+	}
+	task := work.NewTask(sendCrashSummary).Retries(5).NotBefore(due)
+	return email.ForContext(ctx).Enqueue(task)
+}
+
+// Emails a summary of the panics which re-occurred since they were last
+// reported.
+func sendCrashSummary(ctx context.Context) error {
+	rc, ok := redis.TryForContext(ctx)
+	if !ok {
+		return errNoCrashStore
+	}
+	var members *goRedis.StringSliceCmd
+	_, err := rc.TxPipelined(ctx, func(pipe goRedis.Pipeliner) error {
+		members = pipe.SMembers(ctx, crashKey(ctx, "pending"))
+		pipe.Del(ctx, crashKey(ctx, "pending"), crashKey(ctx, "summary-due"))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var crashes []crashSummary
+	for _, fp := range members.Val() {
+		key := crashKey(ctx, fp)
+		fields, err := rc.HGetAll(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		pending, _ := strconv.ParseInt(fields["pending"], 10, 64)
+		if pending <= 0 {
+			// Expired
+			continue
+		}
+		// Occurrences which are recorded in the meantime are left for the
+		// next summary
+		if err := rc.HIncrBy(ctx, key, "pending", -pending).Err(); err != nil {
+			return err
+		}
+		total, _ := strconv.ParseInt(fields["total"], 10, 64)
+		first, _ := strconv.ParseInt(fields["first"], 10, 64)
+		last, _ := strconv.ParseInt(fields["last"], 10, 64)
+		crashes = append(crashes, crashSummary{
+			Fingerprint: fp,
+			Error:       fields["error"],
+			Occurrences: pending,
+			Total:       total,
+			First:       time.Unix(first, 0).UTC(),
+			Last:        time.Unix(last, 0).UTC(),
+		})
+	}
+	if len(crashes) == 0 {
+		return nil
+	}
+	sort.Slice(crashes, func(i, j int) bool {
+		return crashes[i].Occurrences > crashes[j].Occurrences
+	})
+
+	header, ok := errorHeader(config.ForContext(ctx))
+	if !ok {
+		return nil
+	}
+	data := struct {
+		Crashes []crashSummary
+	}{crashes}
+	return email.EnqueueTemplateNotification(ctx, header, "crash-summary", "", &data, nil)
+}
+
+// Forwards a crash report to the configured error tracker, if any.
+func forwardCrash(conf ini.File, report *crashReport) {
+	url, ok := conf.Get("sr.ht", "error-tracker")
+	if !ok {
+		return
+	}
+	body, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("Unable to encode crash report: %v", err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Unable to forward crash report: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token, ok := conf.Get("sr.ht", "error-tracker-token"); ok {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := crashTrackerClient.Do(req)
+	if err != nil {
+		log.Printf("Unable to forward crash report: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf("Error tracker rejected crash report: %s", resp.Status)
+	}
+}
+
+// Returns the header for error reports to [mail]error-to, or false if it is
+// not configured.
+func errorHeader(conf ini.File) (mail.Header, bool) {
+	var header mail.Header
+	to, ok := conf.Get("mail", "error-to")
+	if !ok {
+		return header, false
+	}
+	rcpt, err := mail.ParseAddress(to)
+	if err != nil {
+		panic(fmt.Errorf("Failed to parse [mail]error-to"))
+	}
+	header.SetAddressList("To", []*mail.Address{rcpt})
+	return header, true
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	goRedis "github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/email"
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+	"git.sr.ht/~sircmpwn/core-go/redis"
+)
+
+func crashContext(t *testing.T, options string) (context.Context, string) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(mr.Close)
+
+	ctx, maildir := crashMailContext(t, options)
+	ctx = redis.Context(ctx, goRedis.NewClient(&goRedis.Options{Addr: mr.Addr()}))
+	return ctx, maildir
+}
+
+// Like crashContext, but without Redis.
+func crashMailContext(t *testing.T, options string) (context.Context, string) {
+	maildir := filepath.Join(t.TempDir(), "maildir")
+	conf, err := ini.Load(strings.NewReader(fmt.Sprintf(`
+[sr.ht]
+owner-name=Jane Doe
+owner-email=jdoe@example.org
+%s
+
+[mail]
+smtp-from=test@example.org
+error-to=errors@example.org
+transport=maildir
+maildir=%s`, options, maildir)))
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), conf, "test")
+	return email.Context(ctx, email.NewQueue(conf)), maildir
+}
+
+func TestCrashAggregation(t *testing.T) {
+	ctx, maildir := crashContext(t, "")
+
+	for i := 0; i < 3; i++ {
+		err := EmailRecover(ctx, fmt.Errorf("index out of range [%d]", i))
+		assert.NotNil(t, err)
+	}
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	msgs := emailtest.Maildir(t, maildir)
+	if assert.Len(t, msgs, 1) {
+		assert.Contains(t, msgs[0], "GraphQL query error: index out of range [0]")
+		assert.Contains(t, msgs[0], "Fingerprint: ")
+	}
+
+	// Panics elsewhere are reported separately
+	EmailRecover(ctx, errors.New("nil pointer dereference"))
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 2)
+
+	// Repeated panics are summarized
+	assert.Nil(t, sendCrashSummary(ctx))
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	msgs = emailtest.Maildir(t, maildir)
+	assert.Len(t, msgs, 3)
+	var summary string
+	for _, msg := range msgs {
+		if strings.Contains(msg, "recurring GraphQL query errors") {
+			summary = msg
+		}
+	}
+	assert.Contains(t, summary, "index out of range [0]")
+	assert.Contains(t, summary, "Occurrences: 2 (3 total)")
+	assert.NotContains(t, summary, "nil pointer dereference")
+
+	// Summaries only include new occurrences
+	assert.Nil(t, sendCrashSummary(ctx))
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 3)
+}
+
+func TestCrashWithoutRedis(t *testing.T) {
+	ctx, maildir := crashMailContext(t, "")
+
+	// Every occurrence is emailed right away
+	for i := 0; i < 2; i++ {
+		assert.NotPanics(t, func() {
+			EmailRecover(ctx, errors.New("nil pointer dereference"))
+		})
+	}
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 2)
+	assert.NotNil(t, sendCrashSummary(ctx))
+}
+
+func TestCrashFingerprint(t *testing.T) {
+	var buf, moved [64]uintptr
+	pcs := buf[:runtime.Callers(1, buf[:])]
+	assert.Equal(t,
+		crashFingerprint(errors.New("index 1 at 0xc0001"), pcs),
+		crashFingerprint(errors.New("index 42 at 0xc0002"), pcs))
+	assert.NotEqual(t,
+		crashFingerprint(errors.New("index 1"), pcs),
+		crashFingerprint(errors.New("slice 1"), pcs))
+	assert.NotEqual(t,
+		crashFingerprint(errors.New("index 1"), pcs),
+		crashFingerprint(errors.New("index 1"), pcs[1:]))
+
+	// Line numbers are ignored, so that they may change between deployments
+	assert.Equal(t,
+		crashFingerprint(errors.New("index 1"), pcs),
+		crashFingerprint(errors.New("index 1"),
+			moved[:runtime.Callers(1, moved[:])]))
+}
+
+func TestCrashSummaryInterval(t *testing.T) {
+	conf, err := ini.Load(strings.NewReader(`
+[mail]
+error-summary-interval=10m`))
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, 10*time.Minute, NewServer("test", conf).crashSummaryInterval)
+	assert.Equal(t, defaultCrashSummaryInterval,
+		NewServer("test", ini.File{}).crashSummaryInterval)
+
+	// Invalid intervals are reported when the server is created, rather than
+	// when recovering from a panic
+	conf["mail"]["error-summary-interval"] = "soon"
+	assert.Panics(t, func() { NewServer("test", conf) })
+
+	// Summaries are scheduled with the server's interval
+	ctx, _ := crashContext(t, "")
+	ctx = Context(ctx, &Server{crashSummaryInterval: 10 * time.Minute})
+	assert.Nil(t, scheduleCrashSummary(ctx))
+	v, err := redis.ForContext(ctx).Get(ctx, "crash:test:summary-due").Result()
+	assert.Nil(t, err)
+	due, err := time.Parse(time.RFC3339, v)
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), due, time.Minute)
+}
+
+func TestForwardCrash(t *testing.T) {
+	reports := make(chan crashReport, 1)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+			var report crashReport
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&report))
+			reports <- report
+		}))
+	defer srv.Close()
+
+	ctx, _ := crashContext(t, "error-tracker="+srv.URL+"\nerror-tracker-token=secret")
+	EmailRecover(ctx, errors.New("oh no"))
+	select {
+	case report := <-reports:
+		assert.Equal(t, "test", report.Service)
+		assert.Equal(t, "oh no", report.Error)
+		assert.Len(t, report.Fingerprint, 16)
+		assert.Contains(t, report.Stack, "goroutine")
+		assert.Nil(t, report.Request)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Crash report was not forwarded")
+	}
+}
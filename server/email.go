@@ -5,14 +5,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"log"
-	gomail "net/mail"
 	"runtime"
-	"strings"
+	"time"
 
 	"github.com/99designs/gqlgen/graphql"
-	"github.com/emersion/go-message/mail"
 
 	"git.sr.ht/~sircmpwn/core-go/auth"
 	"git.sr.ht/~sircmpwn/core-go/config"
@@ -20,7 +17,8 @@ import (
 )
 
 // Provides a graphql.RecoverFunc which will print the stack trace, and if
-// debug mode is not enabled, email it to the administrator.
+// debug mode is not enabled, email it to the administrator. Repeated panics
+// are summarized rather than emailed individually; see crash.go.
 func EmailRecover(ctx context.Context, _origErr interface{}) error {
 	log.Println(_origErr)
 	var (
@@ -52,29 +50,20 @@ func EmailRecover(ctx context.Context, _origErr interface{}) error {
 		return fmt.Errorf("internal system error")
 	}
 
-	var header mail.Header
-	header.SetSubject(fmt.Sprintf("[%s] GraphQL query error: %v",
-		config.ServiceName(ctx), origErr))
-
-	conf := config.ForContext(ctx)
-	to, ok := conf.Get("mail", "error-to")
-	if !ok {
-		return fmt.Errorf("internal system error")
-	}
-	rcpt, err := gomail.ParseAddress(to)
-	if err != nil {
-		panic(errors.New("Failed to parse sender address"))
+	var pcs [64]uintptr
+	n := runtime.Callers(2, pcs[:])
+	report := &crashReport{
+		Service:     config.ServiceName(ctx),
+		Fingerprint: crashFingerprint(origErr, pcs[:n]),
+		Error:       origErr.Error(),
+		Stack:       string(stack[:i]),
+		Timestamp:   time.Now().UTC(),
 	}
-	addr := mail.Address(*rcpt)
-	header.SetAddressList("To", []*mail.Address{&addr})
-
-	var reader io.Reader
 	func() {
 		defer func() {
+			// An error occured outside of the GraphQL context
 			if err := recover(); err != nil {
-				reader = strings.NewReader(fmt.Sprintf(`An error occured outside of the GraphQL context:
-
-				%s`, string(stack[:i])))
+				report.Request = nil
 			}
 		}()
 		quser := auth.ForContext(ctx)
@@ -83,25 +72,37 @@ func EmailRecover(ctx context.Context, _origErr interface{}) error {
 		if err != nil {
 			vars = []byte{}[:]
 		}
-		reader = strings.NewReader(
-			fmt.Sprintf(`Error occured processing GraphQL request:
-
-%v
-
-When running the following query on behalf of %s <%s>:
-
-%s
-
-With these variables:
-
-%s
+		report.Request = &graphQLRequest{
+			Username:  quser.Username,
+			Email:     quser.Email,
+			Query:     octx.RawQuery,
+			Variables: string(vars),
+		}
+	}()
 
-The following stack trace was produced:
+	conf := config.ForContext(ctx)
+	go forwardCrash(conf, report)
 
-%s`, origErr, quser.Username, quser.Email, octx.RawQuery,
-				string(vars), string(stack[:i])))
-	}()
+	header, ok := errorHeader(conf)
+	if !ok {
+		return fmt.Errorf("internal system error")
+	}
+	first, err := recordCrash(ctx, report)
+	if err != nil {
+		// Better to send too many emails than none at all
+		log.Printf("Unable to record crash: %v", err)
+		first = true
+	}
+	if !first {
+		return fmt.Errorf("internal system error")
+	}
 
-	email.EnqueueStd(ctx, header, reader, nil)
+	data := struct {
+		Error       error
+		Stack       string
+		Request     *graphQLRequest
+		Fingerprint string
+	}{origErr, report.Stack, report.Request, report.Fingerprint}
+	email.EnqueueTemplateNotification(ctx, header, "graphql-error", "", &data, nil)
 	return fmt.Errorf("internal system error")
 }
@@ -49,6 +49,7 @@ var (
 
 type Server struct {
 	Schema graphql.ExecutableSchema
+	Scopes []string
 
 	conf    ini.File
 	db      *sql.DB
@@ -57,6 +58,9 @@ type Server struct {
 	service string
 	queues  []*work.Queue
 	email   *email.Queue
+	hooks   []func()
+
+	crashSummaryInterval time.Duration
 
 	MaxComplexity int
 }
@@ -67,6 +71,8 @@ func NewServer(service string, conf ini.File) *Server {
 		conf:    conf,
 		router:  chi.NewRouter(),
 		service: service,
+
+		crashSummaryInterval: loadCrashSummaryInterval(conf),
 	}
 	return server
 }
@@ -83,6 +89,7 @@ func (server *Server) Router() chi.Router {
 func (server *Server) WithSchema(
 	schema graphql.ExecutableSchema, scopes []string) *Server {
 	server.Schema = schema
+	server.Scopes = scopes
 
 	var err error
 	if limit, ok := server.conf.Get(
@@ -212,6 +219,9 @@ func (server *Server) WithDefaultMiddleware() *Server {
 		})
 	})
 	server.WithQueues(server.email.Queue)
+	if err := server.email.ScheduleDigests(server.context()); err != nil {
+		log.Printf("Unable to schedule pending email digests: %v", err)
+	}
 	return server
 }
 
@@ -233,6 +243,12 @@ func ForContext(ctx context.Context) *Server {
 	return raw
 }
 
+// Returns a context which has the server attached, for work which is done
+// outside of a request, e.g. by a task queue.
+func Context(ctx context.Context, server *Server) context.Context {
+	return context.WithValue(ctx, serverCtxKey, server)
+}
+
 // Add user-defined middleware to the server
 func (server *Server) WithMiddleware(
 	middlewares ...func(http.Handler) http.Handler) *Server {
@@ -240,19 +256,40 @@ func (server *Server) WithMiddleware(
 	return server
 }
 
+// Adds the handler for the one-click unsubscribe links in bulk email, which
+// requires [mail]suppression-list. See email.UnsubscribeHandler. The route is
+// exempt from authentication, since the links are followed from email clients.
+func (server *Server) WithUnsubscribe() *Server {
+	server.router.Handle("/query/unsubscribe/{token}",
+		email.UnsubscribeHandler())
+	return server
+}
+
 // Add dowork task queues for this server to manage
 func (server *Server) WithQueues(queues ...*work.Queue) *Server {
+	ctx := server.context()
+	server.queues = append(server.queues, queues...)
+	for _, queue := range queues {
+		queue.Start(ctx)
+	}
+	return server
+}
+
+// Returns a context for background work, outside of any request.
+func (server *Server) context() context.Context {
 	ctx := context.Background()
 	ctx = config.Context(ctx, server.conf, server.service)
 	ctx = database.Context(ctx, server.db)
 	ctx = redis.Context(ctx, server.redis)
 	ctx = email.Context(ctx, server.email)
-	ctx = context.WithValue(ctx, serverCtxKey, server)
+	return Context(ctx, server)
+}
 
-	server.queues = append(server.queues, queues...)
-	for _, queue := range queues {
-		queue.Start(ctx)
-	}
+// Adds a function to be called when the server is shutting down, after it
+// stops accepting requests and before the work queues are shut down, e.g. to
+// submit any work which is being held back for later.
+func (server *Server) WithShutdownHook(fn func()) *Server {
+	server.hooks = append(server.hooks, fn)
 	return server
 }
 
@@ -289,6 +326,10 @@ func (server *Server) Run() {
 	qserver.Shutdown(ctx)
 	cancel()
 
+	for _, hook := range server.hooks {
+		hook()
+	}
+
 	log.Println("Terminating work queues...")
 	log.Printf("Progress available via Prometheus stats on port %d",
 		plisten.Addr().(*net.TCPAddr).Port)
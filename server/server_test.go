@@ -0,0 +1,60 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+)
+
+func TestUnsubscribeRoute(t *testing.T) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	t.Cleanup(mr.Close)
+	conf, err := ini.Load(strings.NewReader(fmt.Sprintf(`
+[sr.ht]
+owner-name=Jane Doe
+owner-email=jdoe@example.org
+redis-host=redis://%s
+
+[test]
+connection-string=postgres://localhost/test?sslmode=disable
+
+[mail]
+smtp-from=test@example.org
+transport=maildir
+maildir=%s
+suppression-list=yes`, mr.Addr(), t.TempDir())))
+	if err != nil {
+		panic(err)
+	}
+	srv := httptest.NewServer(NewServer("test", conf).
+		WithDefaultMiddleware().
+		WithUnsubscribe().
+		Router())
+	defer srv.Close()
+
+	// The link is followed without credentials, so it reaches the handler,
+	// which rejects the invalid token, instead of the authentication
+	// middleware
+	resp, err := http.Get(srv.URL + "/query/unsubscribe/garbage")
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.NotContains(t, string(body), "Authorization")
+
+	// Other routes still require authentication
+	resp, err = http.Get(srv.URL + "/query")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
@@ -0,0 +1,182 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	work "git.sr.ht/~sircmpwn/dowork"
+)
+
+// Subscriptions may opt in to batched delivery by setting either of the
+// following nullable integer columns on the subscription table, which are
+// added by MigrateSubscriptions:
+//
+//	batch_size   - the maximum number of events per batch
+//	batch_window - the maximum number of seconds to wait before delivering
+//
+// Batched events are buffered per subscription and delivered as a single JSON
+// array of batchItem. Each event is recorded as a separate delivery, and all
+// of the deliveries in a batch are updated with the same response.
+//
+// Pending batches are only held in memory. Flush delivers them immediately,
+// and should be called before the queues are shut down, e.g. with the server's
+// WithShutdownHook. If the process exits without flushing, the events
+// in pending batches are not delivered, and their delivery records are left
+// without a response.
+const (
+	defaultBatchSize   = 100
+	defaultBatchWindow = 60
+)
+
+type batchItem struct {
+	Delivery string          `json:"delivery"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+type batch struct {
+	deliveries []*delivery
+
+	// Set once no more deliveries may be added to the batch
+	sealed bool
+}
+
+func (sub *WebhookSubscription) batched() bool {
+	return sub.BatchSize != nil || sub.BatchWindow != nil
+}
+
+func (sub *WebhookSubscription) batchLimits() (int, time.Duration) {
+	size, window := defaultBatchSize, defaultBatchWindow
+	if sub.BatchSize != nil && *sub.BatchSize > 0 {
+		size = *sub.BatchSize
+	}
+	if sub.BatchWindow != nil && *sub.BatchWindow > 0 {
+		window = *sub.BatchWindow
+	}
+	return size, time.Duration(window) * time.Second
+}
+
+// Adds a recorded delivery to the pending batch for its subscription, starting
+// a new batch if necessary.
+func (queue *WebhookQueue) enqueueBatched(d *delivery) {
+	sub := d.webhook.Subscription
+	key := fmt.Sprintf("%s/%d", d.webhook.Name, sub.ID)
+	size, window := sub.batchLimits()
+
+	queue.batchMutex.Lock()
+	defer queue.batchMutex.Unlock()
+
+	b, ok := queue.batches[key]
+	if !ok {
+		b = &batch{}
+		queue.batches[key] = b
+		task := queue.batchTask(key, b, sub.URL, true)
+		task.NotBefore(time.Now().UTC().Add(window))
+		queue.pool.Enqueue(task)
+	}
+	b.deliveries = append(b.deliveries, d)
+
+	if len(b.deliveries) >= size {
+		delete(queue.batches, key)
+		b.sealed = true
+		queue.pool.Enqueue(queue.batchTask(key, b, sub.URL, false))
+	}
+}
+
+// Delivers all pending batches immediately, rather than when their windows
+// elapse. This must be called before the queues are shut down, which waits for
+// any batches which are due later.
+func (queue *WebhookQueue) Flush() {
+	queue.batchMutex.Lock()
+	defer queue.batchMutex.Unlock()
+	for key, b := range queue.batches {
+		delete(queue.batches, key)
+		b.sealed = true
+		url := b.deliveries[0].webhook.Subscription.URL
+		queue.pool.Enqueue(queue.batchTask(key, b, url, false))
+	}
+}
+
+// Returns a task which delivers a batch. The task for each batch's window is
+// created along with the batch; if the batch fills up before the window
+// elapses, another task is created to deliver it immediately, and the window
+// task does nothing.
+func (queue *WebhookQueue) batchTask(key string, b *batch,
+	url string, window bool) *work.Task {
+	var (
+		resp  *DeliveryResponse
+		noop  bool
+		first = true
+	)
+	deliver := func(ctx context.Context) error {
+		if window && first {
+			first = false
+			queue.batchMutex.Lock()
+			if b.sealed {
+				noop = true
+			} else {
+				delete(queue.batches, key)
+				b.sealed = true
+			}
+			queue.batchMutex.Unlock()
+		}
+		if noop {
+			return nil
+		}
+		var err error
+		resp, err = queue.deliverBatch(ctx, b.deliveries)
+		return err
+	}
+
+	return queue.pool.NewTask(url, deliver,
+		func(ctx context.Context, task *work.Task) {
+			if noop {
+				return
+			}
+			webhook := b.deliveries[0].webhook
+			if task.Result() == nil {
+				log.Printf("%s/%d: batch of %d webhooks delivered after %d attempts",
+					webhook.Name, webhook.Subscription.ID,
+					len(b.deliveries), task.Attempts())
+			} else {
+				log.Printf("%s/%d: batch of %d webhooks failed after %d attempts: %v",
+					webhook.Name, webhook.Subscription.ID,
+					len(b.deliveries), task.Attempts(), task.Result())
+			}
+			recordDeliveryResult(ctx, queue.columns, queue.maxFailures,
+				"gql_"+webhook.Name+"_wh_sub", webhook.Subscription.ID,
+				webhook.Subscription.URL, deliveryFailed(task, resp))
+		})
+}
+
+// Delivers a sealed batch as a single request.
+func (queue *WebhookQueue) deliverBatch(ctx context.Context,
+	deliveries []*delivery) (*DeliveryResponse, error) {
+	var (
+		items []batchItem
+		ids   []int
+	)
+	for _, d := range deliveries {
+		items = append(items, batchItem{
+			Delivery: d.webhook.PayloadUUID.String(),
+			Event:    d.webhook.Event,
+			Payload:  json.RawMessage(d.payload),
+		})
+		ids = append(ids, d.deliveryID)
+	}
+	payload, err := json.Marshal(items)
+	if err != nil {
+		panic(err)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	headers.Set("X-Webhook-Batch", strconv.Itoa(len(items)))
+	return queue.deliverPayload(ctx, deliveries[0].webhook,
+		headers, payload, ids...)
+}
@@ -0,0 +1,185 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/crypto"
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+func TestBatchDelivery(t *testing.T) {
+	var items []batchItem
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			assert.Equal(t, "2", r.Header.Get("X-Webhook-Batch"))
+			b, err := ioutil.ReadAll(r.Body)
+			assert.Nil(t, err)
+			assert.Nil(t, json.Unmarshal(b, &items))
+
+			nonce := r.Header.Get("X-Payload-Nonce")
+			signature := r.Header.Get("X-Payload-Signature")
+			assert.True(t, crypto.VerifyWebhook(b, nonce, signature))
+		}))
+	defer srv.Close()
+
+	size := 2
+	sub := &WebhookSubscription{
+		ID:        1337,
+		URL:       srv.URL + "/webhook",
+		BatchSize: &size,
+	}
+	queue := NewQueue(nil, testConfig, "test")
+	var uuids []string
+	for i := 0; i < 2; i++ {
+		webhook := &WebhookContext{
+			Name:         "profile",
+			Event:        "PROFILE_UPDATE",
+			PayloadUUID:  uuid.New(),
+			Subscription: sub,
+		}
+		uuids = append(uuids, webhook.PayloadUUID.String())
+		queue.enqueue(&delivery{
+			webhook:    webhook,
+			payload:    []byte(`{"data": {"hello": "world"}}`),
+			deliveryID: 4096 + i,
+		})
+	}
+	assert.Len(t, queue.batches, 0)
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), testConfig, "test")
+	ctx = database.Context(ctx, db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE gql_profile_wh_delivery .* WHERE id IN \(\$4,\$5\)`).
+		WithArgs("", http.StatusOK, sqlmock.AnyArg(), 4096, 4097).
+		WillReturnResult(sqlmock.NewResult(1, 2))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub", "failures", "disabled")
+	mock.ExpectExec(`UPDATE gql_profile_wh_sub`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	// Only the filled batch is due; its window task is not
+	queue.Queue.Dispatch(ctx)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Len(t, items, 2)
+	for i, item := range items {
+		assert.Equal(t, uuids[i], item.Delivery)
+		assert.Equal(t, "PROFILE_UPDATE", item.Event)
+		assert.JSONEq(t, `{"data": {"hello": "world"}}`, string(item.Payload))
+	}
+}
+
+func TestBatchFlush(t *testing.T) {
+	var delivered int
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+			var items []batchItem
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&items))
+			delivered += len(items)
+		}))
+	defer srv.Close()
+
+	window := 3600
+	sub := &WebhookSubscription{
+		ID:          1337,
+		URL:         srv.URL + "/webhook",
+		BatchWindow: &window,
+	}
+	queue := NewQueue(nil, testConfig, "test")
+	queue.enqueue(&delivery{
+		webhook: &WebhookContext{
+			Name:         "profile",
+			Event:        "PROFILE_UPDATE",
+			PayloadUUID:  uuid.New(),
+			Subscription: sub,
+		},
+		payload:    []byte(`{"data": {"hello": "world"}}`),
+		deliveryID: 4096,
+	})
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), testConfig, "test")
+	ctx = database.Context(ctx, db)
+
+	// The batch is not due until its window elapses
+	queue.Queue.Dispatch(ctx)
+	assert.Equal(t, 0, delivered)
+	assert.Len(t, queue.batches, 1)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE gql_profile_wh_delivery`).
+		WithArgs("", http.StatusOK, sqlmock.AnyArg(), 4096).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub")
+	mock.ExpectCommit()
+
+	queue.Flush()
+	queue.Queue.Dispatch(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.Equal(t, 1, delivered)
+	assert.Len(t, queue.batches, 0)
+}
+
+func TestFetchBatchedSubscriptions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub",
+		"secret", "filter", "batch_size", "batch_window")
+	mock.ExpectQuery(`SELECT .*, sub.filter, sub.batch_size, sub.batch_window ` +
+		`FROM gql_profile_wh_sub sub`).
+		WithArgs("PROFILE_UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"sub.id", "sub.user_id", "sub.url", "sub.query", "sub.auth_method",
+			"sub.token_hash", "sub.grants", "sub.client_id", "sub.expires",
+			"sub.node_id", "sub.secret", "sub.filter",
+			"sub.batch_size", "sub.batch_window",
+		}).AddRow(1337, 42, "https://example.org/webhook",
+			"query { me { id } }", auth.AUTH_INTERNAL,
+			nil, nil, "meta.sr.ht", nil, "test", nil,
+			`me.username == "jdoe"`, 10, nil))
+	mock.ExpectCommit()
+
+	queue := NewQueue(nil, testConfig, "test")
+	q := sq.Select().From("gql_profile_wh_sub sub")
+	subs, err := queue.fetchSubscriptions(ctx, q, "profile", "PROFILE_UPDATE")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	if assert.Len(t, subs, 1) {
+		assert.Equal(t, `me.username == "jdoe"`, *subs[0].Filter)
+		assert.True(t, subs[0].batched())
+		assert.Equal(t, 10, *subs[0].BatchSize)
+		assert.Nil(t, subs[0].BatchWindow)
+	}
+}
@@ -0,0 +1,64 @@
+package webhooks
+
+import (
+	"context"
+	"log"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+// A legacy webhook event, produced from a GraphQL webhook event by a
+// LegacyAdapter.
+type LegacyEvent struct {
+	// The select builder and table prefix for the legacy subscribers, as for
+	// LegacyQueue.Schedule
+	Query sq.SelectBuilder
+	Name  string
+
+	Event   string
+	Payload []byte
+}
+
+// Produces the legacy webhook event for a GraphQL webhook payload, or nil if
+// there is no legacy equivalent for this particular payload.
+type LegacyAdapter func(ctx context.Context, payload interface{}) (*LegacyEvent, error)
+
+// Configures the worker to also deliver the given GraphQL webhook event to
+// legacy subscribers, using the adapter to produce the legacy payload. This
+// allows a service to schedule both kinds of webhooks with a single call to
+// Schedule. The legacy queue must be started by the caller as usual.
+//
+// This must be called before the worker is started.
+func (queue *WebhookQueue) BridgeLegacy(lq *LegacyQueue,
+	event string, adapter LegacyAdapter) *WebhookQueue {
+	if queue.legacy != nil && queue.legacy != lq {
+		panic("Only one legacy queue may be bridged")
+	}
+	queue.legacy = lq
+	if queue.adapters == nil {
+		queue.adapters = make(map[string]LegacyAdapter)
+	}
+	queue.adapters[event] = adapter
+	return queue
+}
+
+// Schedules delivery of the legacy equivalent of a GraphQL webhook event, if
+// an adapter has been configured for it.
+func (queue *WebhookQueue) scheduleLegacy(ctx context.Context,
+	event string, payload interface{}) error {
+	adapter, ok := queue.adapters[event]
+	if !ok {
+		return nil
+	}
+	lev, err := adapter(ctx, payload)
+	if err != nil || lev == nil {
+		return err
+	}
+	err = queue.legacy.schedule(ctx, lev.Query, lev.Name, lev.Event, lev.Payload)
+	if err != nil {
+		return err
+	}
+	log.Printf("Bridged %s webhook to legacy %s %s webhook",
+		event, lev.Name, lev.Event)
+	return nil
+}
@@ -0,0 +1,111 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+func TestBridgeLegacy(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+	ctx = auth.InternalWebhookAuth(ctx, &auth.AuthContext{
+		UserID:   42,
+		Username: "jdoe",
+	}, "meta.sr.ht", "test")
+
+	type profile struct {
+		Username string `json:"username"`
+	}
+	lq := NewLegacyQueue(testConfig, "test")
+	queue := NewQueue(nil, testConfig, "test").BridgeLegacy(lq, "PROFILE_UPDATE",
+		func(ctx context.Context, payload interface{}) (*LegacyEvent, error) {
+			p := payload.(*profile)
+			body, err := json.Marshal(p)
+			if err != nil {
+				return nil, err
+			}
+			return &LegacyEvent{
+				Query: sq.
+					Select().
+					From("user_webhook_subscription sub").
+					Where(`sub.user_id = ?`, 42),
+				Name:    "user",
+				Event:   "profile:update",
+				Payload: body,
+			}, nil
+		})
+
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub")
+	mock.ExpectQuery(`SELECT .* FROM gql_profile_wh_sub sub`).
+		WithArgs(42, "PROFILE_UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{"sub.id"}))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectColumns(mock, "user_webhook_subscription")
+	mock.ExpectQuery(`SELECT .* FROM user_webhook_subscription sub`).
+		WithArgs(42, "%profile:update%").
+		WillReturnRows(sqlmock.NewRows([]string{"sub.id"}))
+	mock.ExpectCommit()
+
+	q := sq.
+		Select().
+		From("gql_profile_wh_sub sub").
+		Where(`sub.user_id = ?`, 42)
+	queue.Schedule(ctx, q, "profile", "PROFILE_UPDATE",
+		uuid.New(), &profile{"jdoe"})
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Events without an adapter are not bridged
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM gql_profile_wh_sub sub`).
+		WithArgs(42, "PGP_KEY_ADDED").
+		WillReturnRows(sqlmock.NewRows([]string{"sub.id"}))
+	mock.ExpectCommit()
+	queue.Schedule(ctx, q, "profile", "PGP_KEY_ADDED",
+		uuid.New(), &profile{"jdoe"})
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Errors fetching the legacy subscribers are logged, as for GraphQL
+	// subscribers, rather than causing a panic
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM gql_profile_wh_sub sub`).
+		WithArgs(42, "PROFILE_UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{"sub.id"}))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM user_webhook_subscription sub`).
+		WithArgs(42, "%profile:update%").
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	assert.NotPanics(t, func() {
+		queue.Schedule(ctx, q, "profile", "PROFILE_UPDATE",
+			uuid.New(), &profile{"jdoe"})
+	})
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// As are errors reading them
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM user_webhook_subscription sub`).
+		WithArgs(42, "%profile:update%").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"sub.id", "sub.created", "sub.url", "sub.events",
+		}).AddRow(1337, "yesterday", "https://example.org", "profile:update"))
+	mock.ExpectRollback()
+	err = queue.scheduleLegacy(ctx, "PROFILE_UPDATE", &profile{"jdoe"})
+	assert.NotNil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
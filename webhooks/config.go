@@ -2,20 +2,28 @@ package webhooks
 
 import (
 	"context"
+	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 
 	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/server"
 	sq "github.com/Masterminds/squirrel"
 )
 
 // The following invariants apply to AuthConfig:
-//  1. AuthMethod will be either OAUTH2 or INTERNAL
+//  1. AuthMethod will be either OAUTH2, COOKIE, or INTERNAL
 //  2. If OAUTH2, TokenHash, Grants, and Expires will be non-nil, and ClientID
 //     may be non-nil, and NodeID will be nil.
-//  3. If INTERNAL, TokenHash, Grants, Expires, and ClientID will be nil, and
-//     NodeID will be non-nil.
+//  3. If COOKIE, TokenHash, Grants, and Expires will be non-nil, and ClientID
+//     and NodeID will be nil. TokenHash identifies a grant which was created
+//     for this webhook and is not associated with any OAuth 2.0 token.
+//  4. If INTERNAL, TokenHash, Grants, and Expires will be nil, and ClientID and
+//     NodeID will be non-nil, and identify the internal client which created
+//     the webhook.
 type AuthConfig struct {
 	AuthMethod string
 	TokenHash  *string
@@ -50,36 +58,96 @@ func NewAuthConfig(ctx context.Context) (AuthConfig, error) {
 			ClientID:   clientID,
 		}, nil
 	case auth.AUTH_COOKIE:
-		// TODO: Should this work?
-		return AuthConfig{}, fmt.Errorf("Native webhooks are not supported with web authentication")
+		return cookieAuthConfig(ctx)
 	case auth.AUTH_INTERNAL:
-		// TODO: Should this work?
-		panic("Internal webtoken auth is not supported")
+		clientID := user.InternalAuth.ClientID
+		nodeID := user.InternalAuth.NodeID
+		return AuthConfig{
+			AuthMethod: user.AuthMethod,
+			ClientID:   &clientID,
+			NodeID:     &nodeID,
+		}, nil
 	case auth.AUTH_WEBHOOK:
 		panic("Recursive webhook auth is not supported")
 	}
 	panic("Unreachable")
 }
 
+// Webhooks created with web authentication are valid for this long.
+const cookieGrantLifetime = 365 * 24 * time.Hour
+
+// Web authentication does not come with a token to derive grants from, so
+// we create a grant for read-only access to every scope of this service which
+// expires after cookieGrantLifetime.
+func cookieAuthConfig(ctx context.Context) (AuthConfig, error) {
+	srv := server.ForContext(ctx)
+	if len(srv.Scopes) == 0 {
+		return AuthConfig{}, fmt.Errorf("Native webhooks are not supported with web authentication for this service")
+	}
+
+	service := config.ServiceName(ctx)
+	scopes := make([]string, len(srv.Scopes))
+	for i, scope := range srv.Scopes {
+		scopes[i] = fmt.Sprintf("%s/%s:%s", service, scope, auth.RO)
+	}
+	grants := strings.Join(scopes, " ")
+
+	var grantID [64]byte
+	if _, err := rand.Read(grantID[:]); err != nil {
+		return AuthConfig{}, err
+	}
+	tokenHash := hex.EncodeToString(grantID[:])
+	expires := time.Now().UTC().Add(cookieGrantLifetime).Truncate(time.Second)
+	return AuthConfig{
+		AuthMethod: auth.AUTH_COOKIE,
+		TokenHash:  &tokenHash,
+		Grants:     &grants,
+		Expires:    &expires,
+	}, nil
+}
+
 // Returns an SQL expression to filter webhooks for the authenticated user.
+// Subscriptions whose authorization has expired are included, so that the user
+// can find them and re-bind them with RebindSubscription.
 func FilterWebhooks(ctx context.Context) (sq.Sqlizer, error) {
 	user := auth.ForContext(ctx)
-	ac, err := NewAuthConfig(ctx)
-	if err != nil {
-		return nil, err
-	}
-	if ac.ClientID != nil {
-		// XXX: Should we maybe return all webhooks configured by client ID?
+	switch user.AuthMethod {
+	case auth.AUTH_OAUTH_LEGACY:
+		return nil, fmt.Errorf("Native webhooks are not supported with legacy OAuth")
+	case auth.AUTH_OAUTH2:
+		tokenHash := hex.EncodeToString(user.TokenHash[:])
+		if user.BearerToken.ClientID != "" {
+			// XXX: Should we maybe return all webhooks configured by client
+			// ID?
+			return sq.And{
+				sq.Expr(`token_hash = ?`, tokenHash),
+				sq.Expr(`client_id = ?`, user.BearerToken.ClientID),
+				sq.Expr(`user_id = ?`, user.UserID),
+			}, nil
+		}
+		// Personal access tokens may manage all of the user's webhooks,
+		// including those created from the web UI. Webhooks created by
+		// internal clients have no expiry, and are excluded.
 		return sq.And{
-			sq.Expr(`NOW() at time zone 'utc' < expires`),
-			sq.Expr(`token_hash = ?`, ac.TokenHash),
-			sq.Expr(`client_id = ?`, *ac.ClientID),
+			sq.Expr(`expires IS NOT NULL`),
 			sq.Expr(`user_id = ?`, user.UserID),
 		}, nil
-	} else {
+	case auth.AUTH_COOKIE:
+		// Web authentication is not tied to a token, so all of the user's
+		// webhooks are included, except for those created by internal
+		// clients, which have no expiry
 		return sq.And{
-			sq.Expr(`NOW() at time zone 'utc' < expires`),
+			sq.Expr(`expires IS NOT NULL`),
 			sq.Expr(`user_id = ?`, user.UserID),
 		}, nil
+	case auth.AUTH_INTERNAL:
+		return sq.And{
+			sq.Expr(`auth_method = ?`, auth.AUTH_INTERNAL),
+			sq.Expr(`client_id = ?`, user.InternalAuth.ClientID),
+			sq.Expr(`user_id = ?`, user.UserID),
+		}, nil
+	case auth.AUTH_WEBHOOK:
+		panic("Recursive webhook auth is not supported")
 	}
+	panic("Unreachable")
 }
@@ -0,0 +1,121 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/server"
+)
+
+func TestCookieAuthConfig(t *testing.T) {
+	user := &auth.AuthContext{
+		UserID:     42,
+		Username:   "jdoe",
+		AuthMethod: auth.AUTH_COOKIE,
+	}
+	ctx := config.Context(context.Background(), testConfig, "meta.sr.ht")
+	ctx = auth.Context(ctx, user)
+
+	// Services without scopes cannot derive a grant
+	_, err := NewAuthConfig(server.Context(ctx, &server.Server{}))
+	assert.NotNil(t, err)
+
+	ctx = server.Context(ctx, &server.Server{
+		MaxComplexity: 100,
+		Scopes:        []string{"PROFILE", "SSH_KEYS"},
+	})
+	ac, err := NewAuthConfig(ctx)
+	assert.Nil(t, err)
+	assert.Equal(t, auth.AUTH_COOKIE, ac.AuthMethod)
+	assert.Equal(t, "meta.sr.ht/PROFILE:RO meta.sr.ht/SSH_KEYS:RO", *ac.Grants)
+	assert.Len(t, *ac.TokenHash, 128)
+	assert.WithinDuration(t, time.Now().Add(cookieGrantLifetime),
+		*ac.Expires, time.Minute)
+	assert.Nil(t, ac.ClientID)
+	assert.Nil(t, ac.NodeID)
+
+	// Each subscription has its own grant
+	other, err := NewAuthConfig(ctx)
+	assert.Nil(t, err)
+	assert.NotEqual(t, *ac.TokenHash, *other.TokenHash)
+
+	// Subscriptions created this way are executed with read-only webhook
+	// authentication
+	webhook := &WebhookContext{
+		Name:  "profile",
+		Event: "PROFILE_UPDATE",
+		User:  user,
+		Subscription: &WebhookSubscription{
+			ID:         1337,
+			UserID:     42,
+			Query:      "query { me { username authMethod } }",
+			AuthMethod: ac.AuthMethod,
+			TokenHash:  ac.TokenHash,
+			Grants:     ac.Grants,
+			ClientID:   ac.ClientID,
+			Expires:    ac.Expires,
+			NodeID:     ac.NodeID,
+		},
+	}
+	payload, err := webhook.Exec(ctx, testSchema())
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"data": {"me": {
+		"username": "jdoe",
+		"authMethod": "WEBHOOK"
+	}}}`, string(payload))
+}
+
+func TestFilterWebhooks(t *testing.T) {
+	ctx := config.Context(context.Background(), testConfig, "meta.sr.ht")
+
+	// Listing webhooks with web authentication does not create a grant, and
+	// so does not need the server context
+	filter, err := FilterWebhooks(auth.Context(ctx, &auth.AuthContext{
+		UserID:     42,
+		AuthMethod: auth.AUTH_COOKIE,
+	}))
+	assert.Nil(t, err)
+	sql, args, err := filter.ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, `(expires IS NOT NULL AND user_id = ?)`, sql)
+	assert.Equal(t, []interface{}{42}, args)
+
+	// Personal access tokens see the same webhooks as the web UI
+	filter, err = FilterWebhooks(auth.Context(ctx, &auth.AuthContext{
+		UserID:      42,
+		AuthMethod:  auth.AUTH_OAUTH2,
+		BearerToken: &auth.BearerToken{},
+	}))
+	assert.Nil(t, err)
+	sql, args, err = filter.ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, `(expires IS NOT NULL AND user_id = ?)`, sql)
+	assert.Equal(t, []interface{}{42}, args)
+
+	user := &auth.AuthContext{
+		UserID:     42,
+		AuthMethod: auth.AUTH_INTERNAL,
+		InternalAuth: auth.InternalAuth{
+			Name:     "jdoe",
+			ClientID: "git.sr.ht",
+			NodeID:   "test",
+		},
+	}
+	filter, err = FilterWebhooks(auth.Context(ctx, user))
+	assert.Nil(t, err)
+	sql, args, err = filter.ToSql()
+	assert.Nil(t, err)
+	assert.Equal(t, `(auth_method = ? AND client_id = ? AND user_id = ?)`, sql)
+	assert.Equal(t, []interface{}{auth.AUTH_INTERNAL, "git.sr.ht", 42}, args)
+
+	_, err = FilterWebhooks(auth.Context(ctx, &auth.AuthContext{
+		UserID:     42,
+		AuthMethod: auth.AUTH_OAUTH_LEGACY,
+	}))
+	assert.NotNil(t, err)
+}
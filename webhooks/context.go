@@ -2,6 +2,7 @@ package webhooks
 
 import (
 	"context"
+	"database/sql"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -11,8 +12,11 @@ import (
 	"github.com/99designs/gqlgen/graphql"
 	"github.com/99designs/gqlgen/graphql/executor"
 	"github.com/google/uuid"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 
 	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/database"
 	"git.sr.ht/~sircmpwn/core-go/server"
 )
 
@@ -22,6 +26,15 @@ type contextKey struct {
 
 var payloadContextKey = &contextKey{"webhookPayloadContext"}
 
+// The context in which a webhook query is executed for a single subscription.
+//
+// The query is executed exactly once for each webhook, and the resulting
+// payload is stored with the delivery record. Retries re-send this payload
+// as-is, rather than executing the query again, so every attempt delivers the
+// same data. By default, the query is executed by the worker shortly after the
+// webhook is scheduled, and may observe changes made in the meantime; if the
+// queue is configured WithSnapshots, it is executed before Schedule returns,
+// and the payload describes the state at the time of the event.
 type WebhookContext struct {
 	Name         string
 	Event        string
@@ -45,27 +58,52 @@ func Payload(ctx context.Context) (interface{}, error) {
 	return payload, nil
 }
 
+// Returned by Exec if the subscription's query could not be executed.
+type QueryError struct {
+	Errors gqlerror.List
+}
+
+func (err *QueryError) Error() string {
+	return err.Errors.Error()
+}
+
+// Returns the errors as a GraphQL response body.
+func (err *QueryError) Response() ([]byte, error) {
+	return json.Marshal(&graphql.Response{Errors: err.Errors})
+}
+
 // Executes the GraphQL query prepared stored in the WebhookContext. Handles
 // the configuration of a secondary authentication and GraphQL context.
+//
+// If the query cannot be executed, for instance because it is no longer valid
+// or exceeds the maximum complexity, a *QueryError is returned.
 func (webhook *WebhookContext) Exec(ctx context.Context,
 	schema graphql.ExecutableSchema) ([]byte, error) {
 	sub := webhook.Subscription
-	if sub.AuthMethod != auth.AUTH_OAUTH2 {
-		panic("TODO")
-	}
-	tslice, err := hex.DecodeString(*sub.TokenHash)
-	if err != nil {
-		panic(err)
-	}
+	switch sub.AuthMethod {
+	case auth.AUTH_OAUTH2, auth.AUTH_COOKIE:
+		tslice, err := hex.DecodeString(*sub.TokenHash)
+		if err != nil {
+			panic(err)
+		}
 
-	var tokenHash [64]byte
-	copy(tokenHash[:], tslice)
-	ctx, err = auth.WebhookAuth(ctx, webhook.User,
-		tokenHash, *sub.Grants, sub.ClientID, *sub.Expires)
-	if err != nil {
-		// TODO: This codepath can occur when the token has expired, and we may
-		// want to communicate this to the user.
-		return nil, err
+		var tokenHash [64]byte
+		copy(tokenHash[:], tslice)
+		ctx, err = auth.WebhookAuth(ctx, webhook.User,
+			tokenHash, *sub.Grants, sub.ClientID, *sub.Expires)
+		if err != nil {
+			return nil, err
+		}
+	case auth.AUTH_INTERNAL:
+		// The user who caused the event may have access to resources which
+		// the subscriber does not, so the query is executed as the subscriber
+		owner, err := webhook.owner(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ctx = auth.InternalWebhookAuth(ctx, owner, *sub.ClientID, *sub.NodeID)
+	default:
+		panic(fmt.Errorf("Unsupported webhook auth method %s", sub.AuthMethod))
 	}
 
 	exec := executor.New(schema)
@@ -79,32 +117,68 @@ func (webhook *WebhookContext) Exec(ctx context.Context,
 	ctx = graphql.StartOperationTrace(ctx)
 	rc, errors := exec.CreateOperationContext(ctx, &params)
 	if errors != nil {
-		panic(errors)
+		return nil, &QueryError{errors}
 	}
 	rc.RecoverFunc = server.EmailRecover
 
 	op := rc.Doc.Operations.ForName(rc.OperationName)
+	if op.Operation != ast.Query {
+		// Internal auth is not limited to read-only access
+		return nil, &QueryError{gqlerror.List{
+			gqlerror.Errorf("webhook operations must be queries"),
+		}}
+	}
 	complexity := complexity.Calculate(schema, op, rc.Variables)
 	srv := server.ForContext(ctx)
 	if complexity > srv.MaxComplexity {
-		// TODO: This doesn't bubble up to the user well
-		return nil, fmt.Errorf("operation has complexity %d, which exceeds the maximum of %d",
-			complexity, srv.MaxComplexity)
+		return nil, &QueryError{gqlerror.List{
+			gqlerror.Errorf("operation has complexity %d, which exceeds the maximum of %d",
+				complexity, srv.MaxComplexity),
+		}}
 	}
 
 	var resp graphql.ResponseHandler
 	ctx = graphql.WithOperationContext(ctx, rc)
 	resp, ctx = exec.DispatchOperation(ctx, rc)
-	payload, err := json.Marshal(resp(ctx))
-	if err != nil {
-		panic(err)
+	return json.Marshal(resp(ctx))
+}
+
+// Returns the auth context of the user who owns the subscription.
+func (webhook *WebhookContext) owner(ctx context.Context) (*auth.AuthContext, error) {
+	sub := webhook.Subscription
+	if webhook.User.UserID == sub.UserID {
+		return webhook.User, nil
 	}
-	return payload, nil
+
+	var username string
+	if err := database.WithTx(ctx, &sql.TxOptions{
+		Isolation: 0,
+		ReadOnly:  true,
+	}, func(tx *sql.Tx) error {
+		var err error
+		username, _, err = lookupOwner(ctx, tx, sub.UserID)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	var owner auth.AuthContext
+	if err := auth.LookupUser(ctx, username, &owner); err != nil {
+		return nil, err
+	}
+	return &owner, nil
 }
 
 // Validates the given query against the provided schema and returns any errors
 // should they be found, or nil if the query passes validation.
 func Validate(schema graphql.ExecutableSchema, query string) error {
+	_, err := parseQuery(schema, query)
+	return err
+}
+
+// Parses and validates a webhook query, returning its operation.
+func parseQuery(schema graphql.ExecutableSchema,
+	query string) (*ast.OperationDefinition, error) {
 	// XXX: We would create less garbage if we ran the validator ourselves
 	// instead of letting gqlgen do it for us via CreateOperationContext
 	exec := executor.New(schema)
@@ -116,9 +190,86 @@ func Validate(schema graphql.ExecutableSchema, query string) error {
 		},
 	}
 	ctx := graphql.StartOperationTrace(context.TODO())
-	_, errors := exec.CreateOperationContext(ctx, &params)
+	rc, errors := exec.CreateOperationContext(ctx, &params)
 	if errors != nil {
-		return fmt.Errorf("Error validating webhook query: %s", errors.Error())
+		return nil, fmt.Errorf("Error validating webhook query: %s", errors.Error())
+	}
+	op := rc.Doc.Operations.ForName(rc.OperationName)
+	if op.Operation != ast.Query {
+		return nil, fmt.Errorf("Error validating webhook query: only queries are supported")
+	}
+	return op, nil
+}
+
+// Checks that every field selected by a webhook query may be resolved with
+// the given authentication, following the rules of the directives in
+// server/directives.go. Fields which are not available would otherwise only
+// cause an error when the webhook is delivered.
+func checkAccess(ctx context.Context, schema graphql.ExecutableSchema,
+	query string, ac AuthConfig) error {
+	op, err := parseQuery(schema, query)
+	if err != nil {
+		return err
+	}
+	if ac.AuthMethod == auth.AUTH_INTERNAL {
+		// Internal auth is not limited by grants
+		return nil
+	}
+	grants := auth.DecodeGrants(ctx, *ac.Grants)
+	return checkSelectionAccess(op.SelectionSet, &grants)
+}
+
+func checkSelectionAccess(set ast.SelectionSet, grants *auth.Grants) error {
+	for _, sel := range set {
+		switch sel := sel.(type) {
+		case *ast.Field:
+			if sel.Definition != nil {
+				if err := checkFieldAccess(sel.Definition, grants); err != nil {
+					return err
+				}
+			}
+			if err := checkSelectionAccess(sel.SelectionSet, grants); err != nil {
+				return err
+			}
+		case *ast.InlineFragment:
+			if err := checkSelectionAccess(sel.SelectionSet, grants); err != nil {
+				return err
+			}
+		case *ast.FragmentSpread:
+			if sel.Definition == nil {
+				continue
+			}
+			if err := checkSelectionAccess(sel.Definition.SelectionSet,
+				grants); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkFieldAccess(field *ast.FieldDefinition, grants *auth.Grants) error {
+	for _, dir := range field.Directives {
+		switch dir.Name {
+		case "internal", "anoninternal", "private":
+			return fmt.Errorf("Field %s is not available to webhooks", field.Name)
+		case "access":
+			var scope, kind string
+			if arg := dir.Arguments.ForName("scope"); arg != nil {
+				scope = arg.Value.Raw
+			}
+			if arg := dir.Arguments.ForName("kind"); arg != nil {
+				kind = arg.Value.Raw
+			}
+			if kind != auth.RO {
+				return fmt.Errorf("Field %s requires read/write access, which is not available to webhooks",
+					field.Name)
+			}
+			if !grants.Has(scope, auth.RO) {
+				return fmt.Errorf("Field %s requires access to the %s scope",
+					field.Name, scope)
+			}
+		}
 	}
 	return nil
 }
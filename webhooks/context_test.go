@@ -0,0 +1,157 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+
+	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/database"
+	"git.sr.ht/~sircmpwn/core-go/server"
+)
+
+// Returns a schema whose queries resolve to the authenticated user.
+func testSchema() graphql.ExecutableSchema {
+	schema := gqlparser.MustLoadSchema(&ast.Source{Input: `
+enum AccessScope {
+	PROFILE
+	EMAIL
+}
+
+enum AccessKind {
+	RO
+	RW
+}
+
+directive @access(scope: AccessScope!, kind: AccessKind!) on FIELD_DEFINITION
+directive @private on FIELD_DEFINITION
+
+type User {
+	username: String!
+	authMethod: String!
+	email: String! @access(scope: EMAIL, kind: RO)
+	notes: String! @private
+}
+
+type Query {
+	me: User! @access(scope: PROFILE, kind: RO)
+}
+
+type Mutation {
+	deleteUser: User!
+}`})
+	return &graphql.ExecutableSchemaMock{
+		SchemaFunc: func() *ast.Schema {
+			return schema
+		},
+		ComplexityFunc: func(typeName, fieldName string,
+			childComplexity int, args map[string]interface{}) (int, bool) {
+			return 0, false
+		},
+		ExecFunc: func(ctx context.Context) graphql.ResponseHandler {
+			return func(ctx context.Context) *graphql.Response {
+				user := auth.ForContext(ctx)
+				var data struct {
+					Me struct {
+						Username   string `json:"username"`
+						AuthMethod string `json:"authMethod"`
+					} `json:"me"`
+				}
+				data.Me.Username = user.Username
+				data.Me.AuthMethod = user.AuthMethod
+				body, err := json.Marshal(&data)
+				if err != nil {
+					panic(err)
+				}
+				return &graphql.Response{Data: body}
+			}
+		},
+	}
+}
+
+// Returns a context in which webhook queries may be executed.
+func execContext(ctx context.Context) context.Context {
+	ctx = config.Context(ctx, testConfig, "test")
+	return server.Context(ctx, &server.Server{MaxComplexity: 100})
+}
+
+func TestInternalSubscriptionScope(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := execContext(database.Context(context.Background(), db))
+
+	clientID, nodeID := "meta.sr.ht", "test"
+	webhook := &WebhookContext{
+		Name:  "profile",
+		Event: "PROFILE_UPDATE",
+		User: &auth.AuthContext{
+			UserID:     42,
+			Username:   "jdoe",
+			AuthMethod: auth.AUTH_OAUTH2,
+		},
+		Subscription: &WebhookSubscription{
+			ID:         1337,
+			UserID:     43,
+			Query:      "query { me { username authMethod } }",
+			AuthMethod: auth.AUTH_INTERNAL,
+			ClientID:   &clientID,
+			NodeID:     &nodeID,
+		},
+	}
+
+	// The query is executed as the subscriber, not the user who caused the
+	// event
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT username, email FROM "user" WHERE id = \$1`).
+		WithArgs(43).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}).
+			AddRow("alice", "alice@example.org"))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM "user" u WHERE u.username = \$1`).
+		WithArgs("alice").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"u.id", "u.username", "u.created", "u.updated", "u.email",
+			"u.user_type", "u.url", "u.location", "u.bio",
+			"u.suspension_notice",
+		}).AddRow(43, "alice", time.Now().UTC(), time.Now().UTC(),
+			"alice@example.org", auth.USER_ACTIVE_NON_PAYING,
+			nil, nil, nil, nil))
+	mock.ExpectCommit()
+	payload, err := webhook.Exec(ctx, testSchema())
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.JSONEq(t, `{"data": {"me": {
+		"username": "alice",
+		"authMethod": "INTERNAL"
+	}}}`, string(payload))
+
+	// Subscriptions created by the user who caused the event need no lookup
+	webhook.Subscription.UserID = 42
+	payload, err = webhook.Exec(ctx, testSchema())
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	assert.JSONEq(t, `{"data": {"me": {
+		"username": "jdoe",
+		"authMethod": "INTERNAL"
+	}}}`, string(payload))
+
+	// Internal authentication is not read-only, so mutations are refused
+	webhook.Subscription.Query = "mutation { deleteUser { username } }"
+	_, err = webhook.Exec(ctx, testSchema())
+	var qerr *QueryError
+	if assert.True(t, errors.As(err, &qerr)) {
+		assert.Contains(t, qerr.Error(), "webhook operations must be queries")
+	}
+}
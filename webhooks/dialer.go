@@ -0,0 +1,189 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/valid"
+)
+
+var ErrForbiddenAddress = errors.New("webhook destination address is not permitted")
+
+var sharedAddressSpace = &net.IPNet{
+	IP:   net.IPv4(100, 64, 0, 0),
+	Mask: net.CIDRMask(10, 32),
+}
+
+// Determines which network addresses webhooks may be delivered to.
+//
+// Loopback, private, link-local, and unspecified addresses are refused, as are
+// the networks configured in [<service>::api]internal-ipnet, which are trusted
+// for internal authentication. Networks listed in [webhooks]allowed-ipnet are
+// permitted regardless, e.g. for installations which deliver webhooks to
+// services on a private network.
+type addressPolicy struct {
+	allowed  []*net.IPNet
+	internal []*net.IPNet
+}
+
+func parseIPNets(src string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range strings.Split(src, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// Returns the address policy for the given service. This panics if the
+// configured networks are invalid, and so is called when the queue is created
+// rather than for each delivery.
+func loadAddressPolicy(conf ini.File, service string) *addressPolicy {
+	apiconf := fmt.Sprintf("%s::api", service)
+	src, ok := conf.Get(apiconf, "internal-ipnet")
+	if !ok {
+		// Matches the default in auth.Middleware
+		src = "127.0.0.1/24,::1/64"
+	}
+	internal, err := parseIPNets(src)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse [%s]internal-ipnet: %v", apiconf, err))
+	}
+	src, _ = conf.Get("webhooks", "allowed-ipnet")
+	allowed, err := parseIPNets(src)
+	if err != nil {
+		panic(fmt.Errorf("Unable to parse [webhooks]allowed-ipnet: %v", err))
+	}
+	return &addressPolicy{
+		allowed:  allowed,
+		internal: internal,
+	}
+}
+
+func (policy *addressPolicy) permits(ip net.IP) bool {
+	for _, ipnet := range policy.allowed {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		sharedAddressSpace.Contains(ip) {
+		return false
+	}
+	for _, ipnet := range policy.internal {
+		if ipnet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Checked against the resolved address of every connection, which covers
+// each hop of a redirect and prevents DNS rebinding between validation and
+// delivery.
+func (policy *addressPolicy) control(network, address string,
+	c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !policy.permits(ip) {
+		return fmt.Errorf("%s: %w", host, ErrForbiddenAddress)
+	}
+	return nil
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	return nil
+}
+
+// Returns an HTTP client for webhook deliveries which refuses to connect to
+// forbidden addresses.
+func deliveryClient(policy *addressPolicy) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: policy.control,
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			// No proxy: the dialer must see the final destination
+			Proxy:               nil,
+			DialContext:         dialer.DialContext,
+			DisableKeepAlives:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return checkScheme(req.URL)
+		},
+	}
+}
+
+// Validates a webhook URL when a subscription is created, recording an error
+// for the given field if the URL is malformed or resolves to an address which
+// webhooks may not be delivered to. The address is checked again at delivery
+// time.
+func (queue *WebhookQueue) ValidateURL(ctx context.Context,
+	v *valid.Validation, field, rawURL string) {
+	queue.policy.validateURL(ctx, v, field, rawURL)
+}
+
+// Validates a legacy webhook URL, as with WebhookQueue.ValidateURL.
+func (lq *LegacyQueue) ValidateURL(ctx context.Context,
+	v *valid.Validation, field, rawURL string) {
+	lq.policy.validateURL(ctx, v, field, rawURL)
+}
+
+func (policy *addressPolicy) validateURL(ctx context.Context,
+	v *valid.Validation, field, rawURL string) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		v.Error("Invalid URL: %v", err).WithField(field)
+		return
+	}
+	if err := checkScheme(u); err != nil {
+		v.Error("Invalid URL: %v", err).WithField(field)
+		return
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, u.Hostname())
+	if err != nil {
+		v.Error("Unable to resolve %s", u.Hostname()).WithField(field)
+		return
+	}
+	for _, addr := range addrs {
+		if !policy.permits(addr.IP) {
+			v.Error("Webhooks may not be delivered to %s", u.Hostname()).
+				WithField(field)
+			return
+		}
+	}
+}
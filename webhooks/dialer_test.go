@@ -0,0 +1,119 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/valid"
+)
+
+// Returns the address policy for the given config.
+func testPolicy(src string) *addressPolicy {
+	conf, err := ini.Load(strings.NewReader(src))
+	if err != nil {
+		panic(err)
+	}
+	return loadAddressPolicy(conf, "test")
+}
+
+func TestAddressPolicy(t *testing.T) {
+	policy := testPolicy(`
+[webhooks]
+allowed-ipnet=10.1.2.0/24
+
+[test::api]
+internal-ipnet=203.0.113.0/24`)
+
+	for _, addr := range []string{
+		"127.0.0.1", "::1", "10.0.0.1", "192.168.1.1", "172.16.0.1",
+		"169.254.169.254", "fe80::1", "fd00::1", "0.0.0.0", "100.64.0.1",
+		"::ffff:127.0.0.1", "203.0.113.10",
+	} {
+		assert.False(t, policy.permits(net.ParseIP(addr)), addr)
+	}
+	for _, addr := range []string{
+		"198.51.100.1", "2001:db8::1", "10.1.2.3",
+	} {
+		assert.True(t, policy.permits(net.ParseIP(addr)), addr)
+	}
+}
+
+func TestDeliveryClientRefusesLoopback(t *testing.T) {
+	var called bool
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+	defer srv.Close()
+
+	client := deliveryClient(testPolicy(``))
+	_, err := client.Post(srv.URL, "application/json", nil)
+	assert.True(t, errors.Is(err, ErrForbiddenAddress))
+	assert.False(t, called)
+}
+
+func TestDeliveryClientRedirect(t *testing.T) {
+	var called bool
+	target := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		}))
+	defer target.Close()
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			// Redirect to another loopback address which is not allowed
+			url := strings.Replace(target.URL, "127.0.0.1", "127.0.0.2", 1)
+			http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+		}))
+	defer srv.Close()
+
+	client := deliveryClient(testPolicy(`
+[webhooks]
+allowed-ipnet=127.0.0.1/32`))
+	_, err := client.Post(srv.URL, "application/json", nil)
+	assert.True(t, errors.Is(err, ErrForbiddenAddress))
+	assert.False(t, called)
+}
+
+func TestValidateURL(t *testing.T) {
+	policy := testPolicy(`
+[webhooks]
+allowed-ipnet=10.1.2.0/24`)
+
+	for _, tc := range []struct {
+		url string
+		ok  bool
+	}{
+		{"https://198.51.100.1/webhook", true},
+		{"http://[2001:db8::1]:8080/webhook", true},
+		{"https://10.1.2.3/webhook", true},
+		{"https://127.0.0.1/webhook", false},
+		{"https://[::1]/webhook", false},
+		{"https://10.0.0.1/webhook", false},
+		{"https://192.168.1.1/webhook", false},
+		{"https://169.254.169.254/latest/meta-data", false},
+		{"https://[fe80::1]/webhook", false},
+		{"ftp://198.51.100.1/webhook", false},
+		{"https:///webhook", false},
+	} {
+		ctx := graphql.WithResponseContext(context.Background(),
+			graphql.DefaultErrorPresenter, graphql.DefaultRecover)
+		v := valid.New(ctx)
+		policy.validateURL(ctx, v, "url", tc.url)
+		assert.Equal(t, tc.ok, v.Ok(), tc.url)
+	}
+
+	// Invalid networks are reported when the queue is created, rather than
+	// when a webhook is delivered
+	assert.Panics(t, func() { testPolicy("[webhooks]\nallowed-ipnet=10.1.2.0") })
+	assert.Panics(t, func() { testPolicy("[test::api]\ninternal-ipnet=nope") })
+}
@@ -0,0 +1,156 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+// Subscriptions are disabled after this many consecutive failed deliveries,
+// unless overridden by [webhooks]max-failures.
+const defaultMaxFailures = 50
+
+// Returns the number of consecutive failed deliveries after which a
+// subscription is disabled, or zero if subscriptions are never disabled. This
+// panics if the value is invalid, and so is called when the queue is created
+// rather than after each delivery.
+func loadMaxFailures(conf ini.File) int {
+	limit, ok := conf.Get("webhooks", "max-failures")
+	if !ok {
+		return defaultMaxFailures
+	}
+	max, err := strconv.Atoi(limit)
+	if err != nil || max < 0 {
+		panic(fmt.Errorf("Unable to parse [webhooks]max-failures (must be a non-negative integer)"))
+	}
+	return max
+}
+
+// Updates the consecutive failure count for the subscription of a completed
+// delivery, disabling the subscription and notifying its owner if the
+// configured limit is reached. Table is the name of the subscription table,
+// which is used for both GraphQL and legacy webhooks.
+//
+// Max is the number of failures after which the subscription is disabled, or
+// zero to never disable it.
+//
+// This requires the failures and disabled columns, which are added by
+// MigrateSubscriptions and MigrateLegacySubscriptions. Failures are not
+// counted for tables which have not been migrated.
+func recordDeliveryResult(ctx context.Context, columns *columnCache, max int,
+	table string, id int, url string, failed bool) {
+	var (
+		disabled bool
+		failures int
+		userID   int
+		username string
+		address  string
+	)
+	if err := database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		cols, err := columns.columns(ctx, tx, table)
+		if err != nil || !cols["failures"] || !cols["disabled"] {
+			return err
+		}
+
+		if !failed {
+			_, err := sq.
+				Update(table).
+				Set("failures", 0).
+				Where("id = ?", id).
+				Where("failures <> 0").
+				PlaceholderFormat(sq.Dollar).
+				RunWith(tx).
+				ExecContext(ctx)
+			return err
+		}
+
+		var disable interface{} = false
+		if max > 0 {
+			disable = sq.Expr("failures + 1 >= ?", max)
+		}
+		err = sq.
+			Update(table).
+			Set("failures", sq.Expr("failures + 1")).
+			Set("disabled", disable).
+			Where("id = ?", id).
+			Where("NOT disabled").
+			Suffix(`RETURNING failures, disabled, user_id`).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ScanContext(ctx, &failures, &disabled, &userID)
+		if err == sql.ErrNoRows {
+			// Already disabled
+			return nil
+		} else if err != nil || !disabled {
+			return err
+		}
+		username, address, err = lookupOwner(ctx, tx, userID)
+		return err
+	}); err != nil {
+		log.Printf("Failed to update webhook failure count: %v", err)
+		return
+	}
+
+	if !disabled {
+		return
+	}
+
+	log.Printf("Disabled webhook subscription %s/%d after %d consecutive failures",
+		table, id, failures)
+	if err := notifyDisabled(ctx, url, username, address, failures); err != nil {
+		log.Printf("Failed to notify %s of disabled webhook: %v", username, err)
+	}
+}
+
+func notifyDisabled(ctx context.Context, url string,
+	username, address string, failures int) error {
+	return notifyOwner(ctx, username, address,
+		"Webhook disabled due to delivery failures",
+		fmt.Sprintf(`Your webhook subscription to %s has been disabled after %d consecutive
+failed deliveries. No further events will be delivered to this URL until
+the subscription is re-enabled.
+
+Please check that your receiver is online and responding with a
+successful HTTP status code, then re-enable the subscription.
+`, url, failures))
+}
+
+// Re-enables a subscription which was disabled due to delivery failures and
+// resets its failure count. The caller is responsible for ensuring that the
+// authenticated user is permitted to modify this subscription.
+//
+// Name shall be the prefix of the webhook tables, e.g. "profile" for
+// "gql_profile_wh_{delivery,sub}".
+func EnableSubscription(ctx context.Context, name string, id int) error {
+	return enableSubscription(ctx, "gql_"+name+"_wh_sub", id)
+}
+
+// Re-enables a legacy subscription which was disabled due to delivery
+// failures, as with EnableSubscription.
+//
+// Name shall be the prefix of the webhook tables, e.g. "user" for
+// "user_webhook_{delivery,subscription}".
+func EnableLegacySubscription(ctx context.Context, name string, id int) error {
+	return enableSubscription(ctx, name+"_webhook_subscription", id)
+}
+
+func enableSubscription(ctx context.Context, table string, id int) error {
+	return database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		_, err := sq.
+			Update(table).
+			Set("failures", 0).
+			Set("disabled", false).
+			Where("id = ?", id).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ExecContext(ctx)
+		return err
+	})
+}
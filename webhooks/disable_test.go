@@ -0,0 +1,224 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/stretchr/testify/assert"
+	"github.com/vaughan0/go-ini"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/database"
+	"git.sr.ht/~sircmpwn/core-go/email"
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+)
+
+// Returns a context which delivers email to a maildir, and the path to the
+// maildir.
+func notifyContext(t *testing.T, db *sql.DB) (context.Context, string) {
+	maildir := filepath.Join(t.TempDir(), "maildir")
+	conf, err := ini.Load(strings.NewReader(`
+[webhooks]
+allowed-ipnet=127.0.0.1/32
+max-failures=3
+
+[sr.ht]
+owner-name=Jane Doe
+owner-email=jdoe@example.org
+
+[mail]
+smtp-from=test@example.org
+transport=maildir
+maildir=` + maildir))
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), conf, "test")
+	ctx = database.Context(ctx, db)
+	return email.Context(ctx, email.NewQueue(conf)), maildir
+}
+
+func expectFailure(mock sqlmock.Sqlmock, table string, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`UPDATE `+table+` SET failures = failures \+ 1, `+
+		`disabled = failures \+ 1 >= \$1 WHERE id = \$2 AND NOT disabled `+
+		`RETURNING failures, disabled, user_id`).
+		WithArgs(3, 1337).
+		WillReturnRows(rows)
+}
+
+func TestRecordDeliveryResult(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx, maildir := notifyContext(t, db)
+	columns := newColumnCache()
+
+	// Successful deliveries reset the failure count
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub", "failures", "disabled")
+	mock.ExpectExec(`UPDATE gql_profile_wh_sub SET failures = \$1 `+
+		`WHERE id = \$2 AND failures <> 0`).
+		WithArgs(0, 1337).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	recordDeliveryResult(ctx, columns, 3, "gql_profile_wh_sub",
+		1337, "https://example.org/webhook", false)
+
+	// Failures are counted
+	mock.ExpectBegin()
+	expectFailure(mock, "gql_profile_wh_sub",
+		sqlmock.NewRows([]string{"failures", "disabled", "user_id"}).
+			AddRow(2, false, 42))
+	mock.ExpectCommit()
+	recordDeliveryResult(ctx, columns, 3, "gql_profile_wh_sub",
+		1337, "https://example.org/webhook", true)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 0)
+
+	// The subscription is disabled at the limit, and its owner notified
+	mock.ExpectBegin()
+	expectFailure(mock, "gql_profile_wh_sub",
+		sqlmock.NewRows([]string{"failures", "disabled", "user_id"}).
+			AddRow(3, true, 42))
+	mock.ExpectQuery(`SELECT username, email FROM "user" WHERE id = \$1`).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}).
+			AddRow("jdoe", "jdoe@example.org"))
+	mock.ExpectCommit()
+	recordDeliveryResult(ctx, columns, 3, "gql_profile_wh_sub",
+		1337, "https://example.org/webhook", true)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	msgs := emailtest.Maildir(t, maildir)
+	if assert.Len(t, msgs, 1) {
+		assert.Contains(t, msgs[0], "To: \"~jdoe\" <jdoe@example.org>")
+		assert.Contains(t, msgs[0], "Webhook disabled due to delivery failures")
+		assert.Contains(t, msgs[0], "https://example.org/webhook")
+		assert.Contains(t, msgs[0], "after 3 consecutive")
+	}
+
+	// Subscriptions which are already disabled are left alone
+	mock.ExpectBegin()
+	expectFailure(mock, "gql_profile_wh_sub",
+		sqlmock.NewRows([]string{"failures", "disabled", "user_id"}))
+	mock.ExpectCommit()
+	recordDeliveryResult(ctx, columns, 3, "gql_profile_wh_sub",
+		1337, "https://example.org/webhook", true)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	assert.Len(t, emailtest.Maildir(t, maildir), 1)
+}
+
+func TestMaxFailures(t *testing.T) {
+	assert.Equal(t, defaultMaxFailures, NewQueue(nil, testConfig, "test").maxFailures)
+
+	conf, err := ini.Load(strings.NewReader(`
+[webhooks]
+max-failures=0`))
+	if err != nil {
+		panic(err)
+	}
+	assert.Equal(t, 0, NewLegacyQueue(conf, "test").maxFailures)
+
+	// Invalid limits are reported when the queue is created, rather than
+	// after the first delivery
+	conf["webhooks"]["max-failures"] = "many"
+	assert.Panics(t, func() { NewQueue(nil, conf, "test") })
+	assert.Panics(t, func() { NewLegacyQueue(conf, "test") })
+}
+
+func TestEnableSubscription(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE gql_profile_wh_sub SET failures = \$1, `+
+		`disabled = \$2 WHERE id = \$3`).
+		WithArgs(0, false, 1337).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, EnableSubscription(ctx, "profile", 1337))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE user_webhook_subscription SET failures = \$1, `+
+		`disabled = \$2 WHERE id = \$3`).
+		WithArgs(0, false, 1337).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, EnableLegacySubscription(ctx, "user", 1337))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestLegacyDisable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		}))
+	defer srv.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx, maildir := notifyContext(t, db)
+
+	mock.ExpectBegin()
+	expectColumns(mock, "user_webhook_subscription",
+		"failures", "disabled", "secret")
+	mock.ExpectQuery(`SELECT .* FROM user_webhook_subscription sub`).
+		WillReturnRows(sqlmock.NewRows([]string{
+			"sub.id", "sub.created", "sub.url", "sub.events", "sub.secret",
+		}).AddRow(1337, time.Now().UTC(),
+			srv.URL+"/webhook", "profile:update", nil))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO user_webhook_delivery`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4096))
+	mock.ExpectCommit()
+
+	queue := NewLegacyQueue(config.ForContext(ctx), "test")
+	q := sq.
+		Select().
+		From("user_webhook_subscription sub").
+		Where(`sub.user_id = ?`, 42)
+	queue.Schedule(ctx, q, "user", "profile:update", []byte(`{}`))
+	queue.Queue.Dispatch(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE user_webhook_delivery`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectFailure(mock, "user_webhook_subscription",
+		sqlmock.NewRows([]string{"failures", "disabled", "user_id"}).
+			AddRow(3, true, 42))
+	mock.ExpectQuery(`SELECT username, email FROM "user"`).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}).
+			AddRow("jdoe", "jdoe@example.org"))
+	mock.ExpectCommit()
+	queue.Queue.Dispatch(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	msgs := emailtest.Maildir(t, maildir)
+	if assert.Len(t, msgs, 1) {
+		assert.Contains(t, msgs[0], "Webhook disabled due to delivery failures")
+		assert.Contains(t, msgs[0], srv.URL+"/webhook")
+	}
+}
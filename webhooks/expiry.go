@@ -0,0 +1,175 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+
+	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/database"
+	"git.sr.ht/~sircmpwn/core-go/server"
+)
+
+// Emails the owners of subscriptions whose authorization expires within the
+// given duration, and which have not already been warned. This should be run
+// periodically, e.g. from a daily cron job, with a context which includes the
+// config, database, and email queue.
+//
+// Name shall be the prefix of the webhook tables, e.g. "profile" for
+// "gql_profile_wh_{delivery,sub}". The subscription table must have been
+// migrated with MigrateSubscriptions, which adds the expiry_warned column used
+// to record the warnings. This is reset by RebindSubscription. Subscriptions
+// whose owners could not be emailed are tried again on the next run.
+func NotifyExpiringSubscriptions(ctx context.Context,
+	name string, within time.Duration) error {
+	table := "gql_" + name + "_wh_sub"
+	return database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		cols, err := newColumnCache().columns(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		if !cols["expiry_warned"] {
+			return fmt.Errorf("%s must be migrated with MigrateSubscriptions to warn of expiring subscriptions",
+				table)
+		}
+
+		type expiring struct {
+			id      int
+			url     string
+			expires time.Time
+			userID  int
+		}
+		now := time.Now().UTC()
+		rows, err := sq.
+			Select("id", "url", "expires", "user_id").
+			From(table).
+			Where("NOT expiry_warned").
+			Where("NOT disabled").
+			Where("expires > ?", now).
+			Where("expires < ?", now.Add(within)).
+			Suffix(`FOR UPDATE`).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			QueryContext(ctx)
+		if err != nil {
+			return err
+		}
+		var subs []expiring
+		for rows.Next() {
+			var sub expiring
+			if err := rows.Scan(&sub.id, &sub.url,
+				&sub.expires, &sub.userID); err != nil {
+				rows.Close()
+				return err
+			}
+			subs = append(subs, sub)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		// Only the subscriptions whose owners were emailed are marked as
+		// warned, so that the others are tried again next time
+		var warned []int
+		for _, sub := range subs {
+			username, address, err := lookupOwner(ctx, tx, sub.userID)
+			if err == sql.ErrNoRows {
+				continue
+			} else if err != nil {
+				return err
+			}
+			if err := notifyOwner(ctx, username, address,
+				"Webhook authorization expiring soon",
+				fmt.Sprintf(`The authorization for your webhook subscription #%d expires on
+%s. After this, events will no longer be delivered to
+%s.
+
+To continue receiving webhooks, please update this subscription to use
+a new access token.
+`, sub.id, sub.expires.Format(time.RFC1123), sub.url)); err != nil {
+				log.Printf("Failed to warn %s of expiring webhook: %v",
+					username, err)
+				continue
+			}
+			warned = append(warned, sub.id)
+		}
+		if len(warned) == 0 {
+			return nil
+		}
+		_, err = sq.
+			Update(table).
+			Set("expiry_warned", true).
+			Where(sq.Eq{"id": warned}).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ExecContext(ctx)
+		return err
+	})
+}
+
+// Updates a subscription to use the authentication from the current
+// request, e.g. to continue receiving webhooks after the token used to create
+// it has expired. Returns an error if the subscription does not belong to the
+// authenticated user, or if its query selects any fields which are not
+// accessible with the new authentication.
+//
+// Name shall be the prefix of the webhook tables, e.g. "profile" for
+// "gql_profile_wh_{delivery,sub}".
+func RebindSubscription(ctx context.Context, name string, id int) error {
+	user := auth.ForContext(ctx)
+	ac, err := NewAuthConfig(ctx)
+	if err != nil {
+		return err
+	}
+
+	table := "gql_" + name + "_wh_sub"
+	return database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var query string
+		err := sq.
+			Select("query").
+			From(table).
+			Where("id = ?", id).
+			Where("user_id = ?", user.UserID).
+			Suffix("FOR UPDATE").
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ScanContext(ctx, &query)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("No such webhook subscription")
+		} else if err != nil {
+			return err
+		}
+
+		schema := server.ForContext(ctx).Schema
+		if err := checkAccess(ctx, schema, query, ac); err != nil {
+			return err
+		}
+
+		cols, err := newColumnCache().columns(ctx, tx, table)
+		if err != nil {
+			return err
+		}
+		update := sq.
+			Update(table).
+			Set("auth_method", ac.AuthMethod).
+			Set("token_hash", ac.TokenHash).
+			Set("grants", ac.Grants).
+			Set("client_id", ac.ClientID).
+			Set("expires", ac.Expires).
+			Set("node_id", ac.NodeID)
+		if cols["expiry_warned"] {
+			update = update.Set("expiry_warned", false)
+		}
+		_, err = update.
+			Where("id = ?", id).
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ExecContext(ctx)
+		return err
+	})
+}
@@ -0,0 +1,167 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/database"
+	"git.sr.ht/~sircmpwn/core-go/email"
+	"git.sr.ht/~sircmpwn/core-go/email/emailtest"
+	"git.sr.ht/~sircmpwn/core-go/server"
+)
+
+func expectRebindQuery(mock sqlmock.Sqlmock, id int, query string) {
+	rows := sqlmock.NewRows([]string{"query"})
+	if query != "" {
+		rows.AddRow(query)
+	}
+	mock.ExpectQuery(`SELECT query FROM gql_profile_wh_sub `+
+		`WHERE id = \$1 AND user_id = \$2 FOR UPDATE`).
+		WithArgs(id, 42).
+		WillReturnRows(rows)
+}
+
+func TestRebindSubscription(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+	ctx = server.Context(ctx, &server.Server{Schema: testSchema()})
+	ctx = auth.InternalWebhookAuth(ctx, &auth.AuthContext{
+		UserID:   42,
+		Username: "jdoe",
+	}, "git.sr.ht", "us-east-3.git.sr.ht")
+
+	mock.ExpectBegin()
+	expectRebindQuery(mock, 1337, "query { me { username } }")
+	expectColumns(mock, "gql_profile_wh_sub", "expiry_warned")
+	mock.ExpectExec(`UPDATE gql_profile_wh_sub SET .* WHERE id = \$8`).
+		WithArgs(auth.AUTH_INTERNAL, nil, nil, "git.sr.ht", nil,
+			"us-east-3.git.sr.ht", false, 1337).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, RebindSubscription(ctx, "profile", 1337))
+
+	// Subscriptions which belong to someone else are not updated
+	mock.ExpectBegin()
+	expectRebindQuery(mock, 1234, "")
+	mock.ExpectRollback()
+	assert.NotNil(t, RebindSubscription(ctx, "profile", 1234))
+
+	// Tables without the expiry_warned column are still updated
+	mock.ExpectBegin()
+	expectRebindQuery(mock, 1337, "query { me { username } }")
+	expectColumns(mock, "gql_profile_wh_sub")
+	mock.ExpectExec(`UPDATE gql_profile_wh_sub SET .* node_id = \$6 ` +
+		`WHERE id = \$7`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, RebindSubscription(ctx, "profile", 1337))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestRebindSubscriptionGrants(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), testConfig, "meta.sr.ht")
+	ctx = database.Context(ctx, db)
+	ctx = server.Context(ctx, &server.Server{
+		Schema: testSchema(),
+		Scopes: []string{"PROFILE"},
+	})
+	ctx = auth.Context(ctx, &auth.AuthContext{
+		UserID:     42,
+		Username:   "jdoe",
+		AuthMethod: auth.AUTH_COOKIE,
+	})
+
+	// The query may be executed with the new grants
+	mock.ExpectBegin()
+	expectRebindQuery(mock, 1337, "query { me { username } }")
+	expectColumns(mock, "gql_profile_wh_sub", "expiry_warned")
+	mock.ExpectExec(`UPDATE gql_profile_wh_sub`).
+		WithArgs(auth.AUTH_COOKIE, sqlmock.AnyArg(),
+			"meta.sr.ht/PROFILE:RO", nil, sqlmock.AnyArg(), nil, false, 1337).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, RebindSubscription(ctx, "profile", 1337))
+
+	// Queries which select fields outside of the new grants are refused
+	mock.ExpectBegin()
+	expectRebindQuery(mock, 1337, "query { me { username email } }")
+	mock.ExpectRollback()
+	err = RebindSubscription(ctx, "profile", 1337)
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "EMAIL")
+	}
+
+	// As are queries which select fields which webhooks cannot access
+	mock.ExpectBegin()
+	expectRebindQuery(mock, 1337, "query { me { ...notes } } "+
+		"fragment notes on User { notes }")
+	mock.ExpectRollback()
+	assert.NotNil(t, RebindSubscription(ctx, "profile", 1337))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestNotifyExpiringSubscriptions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx, maildir := notifyContext(t, db)
+
+	expires := time.Now().UTC().Add(72 * time.Hour)
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub",
+		"failures", "disabled", "expiry_warned")
+	mock.ExpectQuery(`SELECT id, url, expires, user_id FROM gql_profile_wh_sub `+
+		`WHERE NOT expiry_warned AND NOT disabled `+
+		`AND expires > \$1 AND expires < \$2 FOR UPDATE`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "url", "expires", "user_id"}).
+			AddRow(1337, "https://example.org/webhook", expires, 42).
+			AddRow(1338, "https://example.org/deleted", expires, 43))
+	mock.ExpectQuery(`SELECT username, email FROM "user" WHERE id = \$1`).
+		WithArgs(42).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}).
+			AddRow("jdoe", "jdoe@example.org"))
+	mock.ExpectQuery(`SELECT username, email FROM "user" WHERE id = \$1`).
+		WithArgs(43).
+		WillReturnRows(sqlmock.NewRows([]string{"username", "email"}))
+	// Subscriptions whose owners were not emailed are not marked as warned
+	mock.ExpectExec(`UPDATE gql_profile_wh_sub SET expiry_warned = \$1 `+
+		`WHERE id IN \(\$2\)`).
+		WithArgs(true, 1337).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	assert.Nil(t, NotifyExpiringSubscriptions(ctx, "profile", 7*24*time.Hour))
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	email.ForContext(ctx).Queue.Dispatch(ctx)
+	msgs := emailtest.Maildir(t, maildir)
+	if assert.Len(t, msgs, 1) {
+		assert.Contains(t, msgs[0], "To: \"~jdoe\" <jdoe@example.org>")
+		assert.Contains(t, msgs[0], "Webhook authorization expiring soon")
+		assert.Contains(t, msgs[0], "subscription #1337 expires on")
+		assert.Contains(t, msgs[0], "\r\nhttps://example.org/webhook.\r\n")
+	}
+
+	// Tables which have not been migrated cannot record the warnings
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub")
+	mock.ExpectRollback()
+	assert.NotNil(t, NotifyExpiringSubscriptions(ctx, "profile", time.Hour))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,388 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Subscriptions may limit the events they receive by setting the following
+// nullable column on the subscription table, which is added by
+// MigrateSubscriptions:
+//
+//	filter text
+//
+// The filter is an expression which is evaluated against the "data" field of
+// the result of the subscription's query. If it evaluates to false, the event
+// is skipped, and no delivery is recorded. If it cannot be evaluated, a
+// delivery is recorded with STATUS_FILTER_ERROR and the reason, but not sent.
+// For example:
+//
+//	event.ref == "refs/heads/main"
+//	ticket.labels.name == "bug" && !ticket.assignee
+//
+// Fields are selected with dot-separated paths. Selecting a field of a list
+// selects that field from each item of the list, and a comparison is true if
+// any of the selected values match; != is true if none of them match. A path
+// on its own is true if any of the selected values are neither null nor
+// false. Values may be strings, numbers, true, false, or null, and
+// expressions may be combined with &&, ||, !, and parentheses.
+type Filter struct {
+	root filterNode
+}
+
+// Returned if a subscription's filter cannot be evaluated.
+type filterError struct {
+	err error
+}
+
+func (err *filterError) Error() string {
+	return fmt.Sprintf("Error evaluating webhook filter: %v", err.err)
+}
+
+// Parses a filter expression.
+func ParseFilter(expr string) (*Filter, error) {
+	p := &filterParser{input: expr}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %s", p.tok)
+	}
+	return &Filter{root}, nil
+}
+
+// Validates a filter expression, returning any errors should they be found,
+// or nil if the filter is valid.
+func ValidateFilter(expr string) error {
+	if _, err := ParseFilter(expr); err != nil {
+		return fmt.Errorf("Error validating webhook filter: %v", err)
+	}
+	return nil
+}
+
+// Returns true if the given GraphQL response matches the filter.
+func (filter *Filter) Match(response []byte) (bool, error) {
+	var resp struct {
+		Data interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(response, &resp); err != nil {
+		return false, err
+	}
+	return filter.root.eval(resp.Data), nil
+}
+
+type filterNode interface {
+	eval(data interface{}) bool
+}
+
+type filterAnd struct{ left, right filterNode }
+type filterOr struct{ left, right filterNode }
+type filterNot struct{ node filterNode }
+
+type filterPath struct {
+	path []string
+}
+
+type filterCompare struct {
+	path  []string
+	equal bool
+	value interface{}
+}
+
+func (n *filterAnd) eval(data interface{}) bool {
+	return n.left.eval(data) && n.right.eval(data)
+}
+
+func (n *filterOr) eval(data interface{}) bool {
+	return n.left.eval(data) || n.right.eval(data)
+}
+
+func (n *filterNot) eval(data interface{}) bool {
+	return !n.node.eval(data)
+}
+
+func (n *filterPath) eval(data interface{}) bool {
+	for _, v := range selectPath(data, n.path) {
+		if v != nil && v != false {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *filterCompare) eval(data interface{}) bool {
+	for _, v := range selectPath(data, n.path) {
+		if v == n.value {
+			return n.equal
+		}
+	}
+	return !n.equal
+}
+
+// Returns all of the values selected by a path. Missing fields are selected
+// as null.
+func selectPath(data interface{}, path []string) []interface{} {
+	values := []interface{}{data}
+	for _, field := range path {
+		var next []interface{}
+		for _, v := range values {
+			next = append(next, selectField(v, field)...)
+		}
+		values = next
+	}
+	return values
+}
+
+func selectField(v interface{}, field string) []interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return []interface{}{v[field]}
+	case []interface{}:
+		var values []interface{}
+		for _, item := range v {
+			values = append(values, selectField(item, field)...)
+		}
+		return values
+	default:
+		return []interface{}{nil}
+	}
+}
+
+const (
+	tokEOF = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokDot
+	tokEq
+	tokNotEq
+	tokAnd
+	tokOr
+	tokNot
+	tokLParen
+	tokRParen
+)
+
+type filterToken struct {
+	kind  int
+	text  string
+	value interface{}
+}
+
+func (tok filterToken) String() string {
+	if tok.kind == tokEOF {
+		return "end of filter"
+	}
+	return strconv.Quote(tok.text)
+}
+
+type filterParser struct {
+	input string
+	pos   int
+	tok   filterToken
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("column %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+var filterOperators = []struct {
+	text string
+	kind int
+}{
+	{"==", tokEq},
+	{"!=", tokNotEq},
+	{"&&", tokAnd},
+	{"||", tokOr},
+	{"!", tokNot},
+	{".", tokDot},
+	{"(", tokLParen},
+	{")", tokRParen},
+}
+
+// Advances to the next token.
+func (p *filterParser) next() error {
+	for p.pos < len(p.input) {
+		r, size := utf8.DecodeRuneInString(p.input[p.pos:])
+		if !unicode.IsSpace(r) {
+			break
+		}
+		p.pos += size
+	}
+	if p.pos >= len(p.input) {
+		p.tok = filterToken{kind: tokEOF}
+		return nil
+	}
+
+	rest := p.input[p.pos:]
+	for _, op := range filterOperators {
+		if strings.HasPrefix(rest, op.text) {
+			p.tok = filterToken{kind: op.kind, text: op.text}
+			p.pos += len(op.text)
+			return nil
+		}
+	}
+
+	c, end := utf8.DecodeRuneInString(rest)
+	switch {
+	case c == '"':
+		for end < len(rest) && rest[end] != '"' {
+			if rest[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(rest) {
+			return p.errorf("unterminated string")
+		}
+		end++
+		s, err := strconv.Unquote(rest[:end])
+		if err != nil {
+			return p.errorf("invalid string %s", rest[:end])
+		}
+		p.tok = filterToken{kind: tokString, text: rest[:end], value: s}
+	case c == '-' || (c >= '0' && c <= '9'):
+		for end < len(rest) && strings.IndexByte("0123456789.", rest[end]) != -1 {
+			end++
+		}
+		n, err := strconv.ParseFloat(rest[:end], 64)
+		if err != nil {
+			return p.errorf("invalid number %s", rest[:end])
+		}
+		p.tok = filterToken{kind: tokNumber, text: rest[:end], value: n}
+	case c == '_' || unicode.IsLetter(c):
+		for end < len(rest) {
+			r, size := utf8.DecodeRuneInString(rest[end:])
+			if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				break
+			}
+			end += size
+		}
+		p.tok = filterToken{kind: tokIdent, text: rest[:end]}
+	default:
+		return p.errorf("unexpected character %q", c)
+	}
+	p.pos += end
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokOr {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokAnd {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &filterAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	switch p.tok.kind {
+	case tokNot:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &filterNot{node}, nil
+	case tokLParen:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokRParen {
+			return nil, p.errorf("expected \")\", got %s", p.tok)
+		}
+		return node, p.next()
+	case tokIdent:
+		return p.parseComparison()
+	default:
+		return nil, p.errorf("expected field, got %s", p.tok)
+	}
+}
+
+func (p *filterParser) parseComparison() (filterNode, error) {
+	path := []string{p.tok.text}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for p.tok.kind == tokDot {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		if p.tok.kind != tokIdent {
+			return nil, p.errorf("expected field, got %s", p.tok)
+		}
+		path = append(path, p.tok.text)
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.tok.kind != tokEq && p.tok.kind != tokNotEq {
+		return &filterPath{path}, nil
+	}
+	equal := p.tok.kind == tokEq
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+
+	var value interface{}
+	switch p.tok.kind {
+	case tokString, tokNumber:
+		value = p.tok.value
+	case tokIdent:
+		switch p.tok.text {
+		case "true":
+			value = true
+		case "false":
+			value = false
+		case "null":
+			value = nil
+		default:
+			return nil, p.errorf("expected value, got %s", p.tok)
+		}
+	default:
+		return nil, p.errorf("expected value, got %s", p.tok)
+	}
+	return &filterCompare{path, equal, value}, p.next()
+}
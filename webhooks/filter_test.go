@@ -0,0 +1,116 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+func TestFilter(t *testing.T) {
+	response := []byte(`{"data": {"event": {
+		"ref": "refs/heads/main",
+		"size": 3,
+		"forced": false,
+		"assignee": null,
+		"labels": [{"name": "bug"}, {"name": "ui"}],
+		"título": "ü"
+	}}}`)
+
+	for _, tc := range []struct {
+		expr  string
+		match bool
+	}{
+		{`event.ref == "refs/heads/main"`, true},
+		{`event.ref != "refs/heads/main"`, false},
+		{`event.ref == "refs/heads/dev"`, false},
+		{`event.size == 3`, true},
+		{`event.forced == false`, true},
+		{`event.forced`, false},
+		{`!event.assignee`, true},
+		{`event.missing == null`, true},
+		{`event.labels.name == "ui"`, true},
+		{`event.labels.name != "bug"`, false},
+		{`event.labels.name == "docs"`, false},
+		{`event.forced || event.size == 3`, true},
+		{`event.size == 3 && !(event.labels.name == "bug")`, false},
+		{`event.título == "ü"`, true},
+		{"event.size\u00a0==\u20033", true},
+	} {
+		filter, err := ParseFilter(tc.expr)
+		if !assert.Nil(t, err, tc.expr) {
+			continue
+		}
+		match, err := filter.Match(response)
+		assert.Nil(t, err, tc.expr)
+		assert.Equal(t, tc.match, match, tc.expr)
+	}
+
+	for _, expr := range []string{
+		``,
+		`event.ref ==`,
+		`event.ref == refs`,
+		`"main" == event.ref`,
+		`event. == 1`,
+		`(event.forced`,
+		`event.ref == "main`,
+		`event.ref = "main"`,
+		`event.forced event.size`,
+		`event.ref == "main" ✓`,
+		"event.ref == \xff",
+	} {
+		assert.NotNil(t, ValidateFilter(expr), expr)
+	}
+}
+
+func TestPrepareFiltered(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+
+	filter := `me.username == "jdoe"`
+	queue := NewQueue(nil, testConfig, "test")
+	queue.prepare(ctx, []*execution{{
+		webhook: &WebhookContext{
+			Name:  "profile",
+			Event: "PROFILE_UPDATE",
+			Subscription: &WebhookSubscription{
+				ID:     1337,
+				URL:    "https://example.org/webhook",
+				Filter: &filter,
+			},
+		},
+		payload: []byte(`{"data": {"me": {"username": "rms"}}}`),
+	}})
+
+	// Filtered events are not recorded
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Filters which cannot be evaluated are recorded in place of the delivery
+	filter = `me.username ==`
+	webhook := &WebhookContext{
+		Name:  "profile",
+		Event: "PROFILE_UPDATE",
+		Subscription: &WebhookSubscription{
+			ID:     1337,
+			URL:    "https://example.org/webhook",
+			Filter: &filter,
+		},
+	}
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO gql_profile_wh_delivery`).
+		WithArgs(webhook.PayloadUUID, "PROFILE_UPDATE", 1337, "",
+			STATUS_FILTER_ERROR, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	queue.prepare(ctx, []*execution{{
+		webhook: webhook,
+		payload: []byte(`{"data": {"me": {"username": "rms"}}}`),
+	}})
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -15,6 +16,8 @@ import (
 	"git.sr.ht/~sircmpwn/dowork"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"github.com/vaughan0/go-ini"
 
 	"git.sr.ht/~sircmpwn/core-go/crypto"
 	"git.sr.ht/~sircmpwn/core-go/database"
@@ -22,6 +25,11 @@ import (
 
 type LegacyQueue struct {
 	Queue *work.Queue
+
+	pool        *deliveryPool
+	columns     *columnCache
+	maxFailures int
+	policy      *addressPolicy
 }
 
 type LegacySubscription struct {
@@ -29,16 +37,37 @@ type LegacySubscription struct {
 	Created time.Time
 	URL     string
 	Events  []string
+	// See secret.go; nil if the subscription has no secret
+	Secret []byte
 }
 
 // Creates a new worker for delivering legacy webhooks. The caller must start
-// the worker themselves.
-func NewLegacyQueue() *LegacyQueue {
+// the worker themselves. The config is read as with NewQueue.
+func NewLegacyQueue(conf ini.File, service string) *LegacyQueue {
+	queue := work.NewQueue("webhooks_legacy")
 	return &LegacyQueue{
-		work.NewQueue("webhooks_legacy"),
+		Queue:       queue,
+		pool:        newDeliveryPool(queue, "webhooks_legacy", 1, 0),
+		columns:     newColumnCache(),
+		maxFailures: loadMaxFailures(conf),
+		policy:      loadAddressPolicy(conf, service),
 	}
 }
 
+// Configures the number of workers which deliver webhooks concurrently, and
+// the maximum number of those workers which may be used for deliveries to a
+// single host (or zero for no limit). This must be called before the worker is
+// started, and the caller must start all of the queues returned by Queues.
+func (lq *LegacyQueue) WithConcurrency(workers, perHost int) *LegacyQueue {
+	lq.pool = newDeliveryPool(lq.Queue, "webhooks_legacy", workers, perHost)
+	return lq
+}
+
+// Returns all of the work queues used by this worker.
+func (lq *LegacyQueue) Queues() []*work.Queue {
+	return lq.pool.Queues()
+}
+
 // Schedules delivery of a legacy webhook to a set of subscribers.
 //
 // The select builder should not return any columns, i.e. the caller should use
@@ -51,6 +80,13 @@ func NewLegacyQueue() *LegacyQueue {
 // "user_webhook_{delivery,subscription}".
 func (lq *LegacyQueue) Schedule(ctx context.Context, q sq.SelectBuilder,
 	name, event string, payload []byte) {
+	if err := lq.schedule(ctx, q, name, event, payload); err != nil {
+		panic(err)
+	}
+}
+
+func (lq *LegacyQueue) schedule(ctx context.Context, q sq.SelectBuilder,
+	name, event string, payload []byte) error {
 	// The following tasks are done during this process:
 	//
 	// 1. Fetch subscription details from the database
@@ -59,13 +95,13 @@ func (lq *LegacyQueue) Schedule(ctx context.Context, q sq.SelectBuilder,
 	//
 	// The first two steps are done in this task, then N tasks are created for
 	// step 3 where N = number of subscriptions.
-	subs, err := fetchSubscriptions(ctx, q, event)
+	subs, err := lq.fetchSubscriptions(ctx, q, name, event)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if len(subs) == 0 {
-		return
+		return nil
 	}
 
 	task := work.NewTask(func(ctx context.Context) error {
@@ -86,30 +122,49 @@ func (lq *LegacyQueue) Schedule(ctx context.Context, q sq.SelectBuilder,
 		}
 
 		for _, task := range tasks {
-			lq.Queue.Enqueue(task)
+			lq.pool.Enqueue(task)
 		}
 		log.Printf("Enqueued %s %s webhook delivery for %d subscriptions",
 			name, event, len(subs))
 		return nil
 	})
-	lq.Queue.Enqueue(task)
+	return lq.Queue.Enqueue(task)
 }
 
-func fetchSubscriptions(ctx context.Context, q sq.SelectBuilder,
-	event string) ([]*LegacySubscription, error) {
-
+func (lq *LegacyQueue) fetchSubscriptions(ctx context.Context,
+	q sq.SelectBuilder, name, event string) ([]*LegacySubscription, error) {
 	var subs []*LegacySubscription
 	if err := database.WithTx(ctx, &sql.TxOptions{
 		Isolation: 0,
 		ReadOnly:  true,
 	}, func(tx *sql.Tx) error {
-		var (
-			err  error
-			rows *sql.Rows
-		)
+		cols, err := lq.columns.types(ctx, tx,
+			name+"_webhook_subscription")
+		if err != nil {
+			return err
+		}
+
+		// Tables migrated with MigrateLegacyEvents store events as an
+		// array, which is matched exactly using its GIN index
+		arrays := cols["events"] == "ARRAY"
+		if arrays {
+			q = q.Where("sub.events @> ARRAY[?]::varchar[]", event)
+		} else {
+			q = q.Where(sq.Like{"sub.events": "%" + event + "%"})
+		}
+		if _, ok := cols["disabled"]; ok {
+			q = q.Where("NOT sub.disabled")
+		}
+
+		// Secrets are only available if the table has been migrated
+		_, secrets := cols["secret"]
+		q = q.Columns("sub.id", "sub.created", "sub.url", "sub.events")
+		if secrets {
+			q = q.Columns("sub.secret")
+		}
+
+		var rows *sql.Rows
 		if rows, err = q.
-			Columns("sub.id", "sub.created", "sub.url", "sub.events").
-			Where(sq.Like{"sub.events": "%" + event + "%"}).
 			PlaceholderFormat(sq.Dollar).
 			RunWith(tx).
 			QueryContext(ctx); err != nil {
@@ -117,18 +172,33 @@ func fetchSubscriptions(ctx context.Context, q sq.SelectBuilder,
 		}
 		defer rows.Close()
 
-		var events string
 		for rows.Next() {
-			var sub LegacySubscription
-			if err := rows.Scan(&sub.ID, &sub.Created,
-				&sub.URL, &events); err != nil {
-				panic(err)
+			var (
+				sub    LegacySubscription
+				events sql.NullString
+				array  pq.StringArray
+			)
+			dest := []interface{}{&sub.ID, &sub.Created, &sub.URL, &events}
+			if arrays {
+				dest[3] = &array
+			}
+			if secrets {
+				dest = append(dest, &sub.Secret)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return err
+			}
+
+			if arrays {
+				sub.Events = array
+				subs = append(subs, &sub)
+				continue
 			}
 
 			// The LIKE clause gets us an approximate list of implicated
 			// subscriptions, so we quickly decode the event list and
 			// double check here to get the final list.
-			sub.Events = strings.Split(events, ",")
+			sub.Events = strings.Split(events.String, ",")
 
 			var valid bool
 			for _, e := range sub.Events {
@@ -142,7 +212,7 @@ func fetchSubscriptions(ctx context.Context, q sq.SelectBuilder,
 				subs = append(subs, &sub)
 			}
 		}
-		return nil
+		return rows.Err()
 	}); err != nil {
 		return nil, err
 	}
@@ -150,6 +220,55 @@ func fetchSubscriptions(ctx context.Context, q sq.SelectBuilder,
 	return subs, nil
 }
 
+// Converts the comma-separated events column of a legacy subscription table
+// to an array with a GIN index, so that events may be matched exactly and
+// efficiently. The migration does nothing if the column has already been
+// converted, and running workers pick up the new column type when restarted. This is equivalent to the following SQL, which
+// may be used instead with your usual migration tooling:
+//
+//	ALTER TABLE {name}_webhook_subscription
+//		ALTER COLUMN events TYPE varchar[]
+//		USING string_to_array(events, ',');
+//	CREATE INDEX {name}_webhook_subscription_events_idx
+//		ON {name}_webhook_subscription USING GIN (events);
+//
+// Name shall be the prefix of the webhook tables, e.g. "user" for
+// "user_webhook_{delivery,subscription}". Any other code which writes to the
+// events column must be updated to write arrays before this is run.
+func MigrateLegacyEvents(ctx context.Context, name string) error {
+	table := name + "_webhook_subscription"
+	return database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var dataType string
+		if err := sq.
+			Select("data_type").
+			From("information_schema.columns").
+			Where("table_schema = current_schema()").
+			Where("table_name = ?", table).
+			Where("column_name = 'events'").
+			PlaceholderFormat(sq.Dollar).
+			RunWith(tx).
+			ScanContext(ctx, &dataType); err != nil {
+			return err
+		}
+		if dataType == "ARRAY" {
+			return nil
+		}
+
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`
+			ALTER TABLE %[1]s
+				ALTER COLUMN events TYPE varchar[]
+				USING string_to_array(events, ',');
+			CREATE INDEX %[2]s
+				ON %[1]s USING GIN (events);`,
+			pq.QuoteIdentifier(table),
+			pq.QuoteIdentifier(table+"_events_idx"))); err != nil {
+			return err
+		}
+		log.Printf("Migrated %s events to an array", table)
+		return nil
+	})
+}
+
 // Inserts the delivery record and schedules the actual delivery task
 func (lq *LegacyQueue) queueStage2(ctx context.Context, tx *sql.Tx,
 	name, event string, sub *LegacySubscription,
@@ -180,9 +299,13 @@ func (lq *LegacyQueue) queueStage2(ctx context.Context, tx *sql.Tx,
 		return nil, err
 	}
 
-	return work.NewTask(func(ctx context.Context) error {
-		return deliverPayload(ctx, name, sub.URL, headers, payload, deliveryID)
-	}).Retries(5).After(func(ctx context.Context, task *work.Task) {
+	var resp *DeliveryResponse
+	return lq.pool.NewTask(sub.URL, func(ctx context.Context) error {
+		var err error
+		resp, err = lq.deliverPayload(ctx, name, sub.URL, sub.Secret,
+			headers, payload, deliveryID)
+		return err
+	}, func(ctx context.Context, task *work.Task) {
 		if task.Result() == nil {
 			log.Printf("%s: webhook delivery complete after %d attempts",
 				deliveryUUID, task.Attempts())
@@ -190,22 +313,24 @@ func (lq *LegacyQueue) queueStage2(ctx context.Context, tx *sql.Tx,
 			log.Printf("%s: webhook delivery failed after %d attempts: %v",
 				deliveryUUID, task.Attempts(), task.Result())
 		}
+		recordDeliveryResult(ctx, lq.columns, lq.maxFailures,
+			name+"_webhook_subscription", sub.ID, sub.URL,
+			deliveryFailed(task, resp))
 	}), nil
 }
 
 // Performs a webhook delivery and updates the delivery record in the database
-func deliverPayload(ctx context.Context, name, url string,
-	headers http.Header, payload []byte, deliveryID int) error {
+func (lq *LegacyQueue) deliverPayload(ctx context.Context,
+	name, url string, secret []byte, headers http.Header, payload []byte,
+	deliveryID int) (*DeliveryResponse, error) {
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	client := deliveryClient(lq.policy)
 	rctx, cancel := context.WithDeadline(ctx, time.Now().Add(30*time.Second))
 	req, err := http.NewRequestWithContext(rctx,
 		http.MethodPost, url, bytes.NewReader(payload))
 	defer cancel()
 	if err != nil {
-		return fmt.Errorf("http.NewRequestWithContext: %v: %w",
+		return nil, fmt.Errorf("http.NewRequestWithContext: %v: %w",
 			err, work.ErrDoNotReattempt)
 	}
 
@@ -218,23 +343,34 @@ func deliverPayload(ctx context.Context, name, url string,
 	nonce, sig := crypto.SignWebhook(payload)
 	req.Header.Add("X-Payload-Nonce", nonce)
 	req.Header.Add("X-Payload-Signature", sig)
+	if err := signWithSecret(req.Header, secret, payload); err != nil {
+		return nil, fmt.Errorf("%v: %w", err, work.ErrDoNotReattempt)
+	}
 
 	var ours strings.Builder
 	req.Header.Write(&ours)
 
 	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if errors.Is(err, ErrForbiddenAddress) {
+		return nil, fmt.Errorf("%v: %w", err, work.ErrDoNotReattempt)
+	} else if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	reader := io.LimitReader(resp.Body, 65536) // No more than 64 KiB
 	body, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return fmt.Errorf("Error reading response body: %v: %w",
+		return nil, fmt.Errorf("Error reading response body: %v: %w",
 			err, work.ErrDoNotReattempt)
 	}
 
+	response := &DeliveryResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+		Body:       body,
+	}
+
 	if err = database.WithTx(ctx, nil, func(tx *sql.Tx) error {
 		var theirs strings.Builder
 		resp.Header.Write(&theirs)
@@ -251,16 +387,16 @@ func deliverPayload(ctx context.Context, name, url string,
 		return err
 	}); err != nil {
 		log.Printf("Warning: webhook delivered, but updating delivery record failed: %v", err)
-		return nil
+		return response, nil
 	}
 
 	if resp.StatusCode == http.StatusBadGateway ||
 		resp.StatusCode == http.StatusServiceUnavailable ||
 		resp.StatusCode == http.StatusGatewayTimeout {
 		// Retry
-		return fmt.Errorf("Server returned status %d: %s",
+		return response, fmt.Errorf("Server returned status %d: %s",
 			resp.StatusCode, resp.Status)
 	}
 
-	return nil
+	return response, nil
 }
@@ -15,14 +15,18 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/vaughan0/go-ini"
 
+	"git.sr.ht/~sircmpwn/core-go/config"
 	"git.sr.ht/~sircmpwn/core-go/crypto"
 	"git.sr.ht/~sircmpwn/core-go/database"
 )
 
+var testConfig ini.File
+
 func init() {
 	conf, err := ini.Load(strings.NewReader(`
 [webhooks]
 private-key=ebzsjPaN6E13ln/FeNWly1C92q6bVMVdOnDo1HPl5fc=
+allowed-ipnet=127.0.0.1/32
 
 [sr.ht]
 network-key=tbuG-7Vh44vrDq1L_HKWkHnWrDOtJhEkPKPiauaLeuk=
@@ -33,6 +37,7 @@ internal-ipnet=127.0.0.1/24,::1/64`))
 		panic(err)
 	}
 	crypto.InitCrypto(conf)
+	testConfig = conf
 }
 
 type argContains struct {
@@ -86,19 +91,22 @@ func TestDelivery(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	ctx := database.Context(context.Background(), db)
+	ctx := config.Context(context.Background(), testConfig, "test")
+	ctx = database.Context(ctx, db)
 
 	// Lookup phase
 	mock.ExpectBegin()
+	expectColumns(mock, "user_webhook_subscription",
+		"failures", "disabled", "secret")
 	mock.ExpectQuery(`SELECT .* FROM user_webhook_subscription sub`).
 		WillReturnRows(sqlmock.NewRows([]string{
-			"sub.id", "sub.created", "sub.url", "sub.events",
+			"sub.id", "sub.created", "sub.url", "sub.events", "sub.secret",
 		}).AddRow(1337, time.Now().UTC(),
-						srv.URL+"/webhook", "profile:update")).
+						srv.URL+"/webhook", "profile:update", nil)).
 		WithArgs(42, sqlmock.AnyArg()) // Any => events LIKE %profile:update%
 	mock.ExpectCommit()
 
-	queue := NewLegacyQueue()
+	queue := NewLegacyQueue(testConfig, "test")
 	q := sq.
 		Select().
 		From("user_webhook_subscription sub").
@@ -134,10 +142,82 @@ func TestDelivery(t *testing.T) {
 			4096).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE user_webhook_subscription SET failures = \$1 `+
+		`WHERE id = \$2 AND failures <> 0`).
+		WithArgs(0, 1337).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
 
-	ctx = database.Context(context.Background(), db)
+	ctx = config.Context(context.Background(), testConfig, "test")
+	ctx = database.Context(ctx, db)
 	queue.Queue.Dispatch(ctx)
 
 	assert.Nil(t, mock.ExpectationsWereMet())
 	assert.True(t, called)
 }
+
+func TestFetchEventArrays(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+
+	mock.ExpectBegin()
+	expectColumns(mock, "user_webhook_subscription",
+		"events[]", "failures", "disabled", "secret")
+	mock.ExpectQuery(`SELECT .* FROM user_webhook_subscription sub `+
+		`WHERE sub.user_id = \$1 AND sub.events @> ARRAY\[\$2\]::varchar\[\] `+
+		`AND NOT sub.disabled`).
+		WithArgs(42, "profile:update").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"sub.id", "sub.created", "sub.url", "sub.events", "sub.secret",
+		}).AddRow(1337, time.Now().UTC(), "https://example.org/webhook",
+			"{profile:update,ssh-key:add}", nil))
+	mock.ExpectCommit()
+
+	queue := NewLegacyQueue(testConfig, "test")
+	q := sq.
+		Select().
+		From("user_webhook_subscription sub").
+		Where(`sub.user_id = ?`, 42)
+	subs, err := queue.fetchSubscriptions(ctx, q, "user", "profile:update")
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+	if assert.Len(t, subs, 1) {
+		assert.Equal(t, []string{"profile:update", "ssh-key:add"},
+			subs[0].Events)
+	}
+}
+
+func TestMigrateLegacyEvents(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT data_type FROM information_schema.columns ` +
+		`WHERE table_schema = current_schema\(\) AND table_name = \$1`).
+		WithArgs("user_webhook_subscription").
+		WillReturnRows(sqlmock.NewRows([]string{"data_type"}).
+			AddRow("character varying"))
+	mock.ExpectExec(`ALTER TABLE "user_webhook_subscription"`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	assert.Nil(t, MigrateLegacyEvents(ctx, "user"))
+
+	// Migrated tables are left alone
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT data_type FROM information_schema.columns ` +
+		`WHERE table_schema = current_schema\(\) AND table_name = \$1`).
+		WithArgs("user_webhook_subscription").
+		WillReturnRows(sqlmock.NewRows([]string{"data_type"}).
+			AddRow("ARRAY"))
+	mock.ExpectCommit()
+	assert.Nil(t, MigrateLegacyEvents(ctx, "user"))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
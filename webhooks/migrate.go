@@ -0,0 +1,163 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+// A column which this package uses, but which subscription tables created
+// before it was introduced do not have.
+type column struct {
+	name       string
+	definition string
+}
+
+// Optional columns of the GraphQL webhook subscription tables.
+var subscriptionColumns = []column{
+	{"failures", "integer NOT NULL DEFAULT 0"},
+	{"disabled", "boolean NOT NULL DEFAULT false"},
+	{"batch_size", "integer"},
+	{"batch_window", "integer"},
+	{"expiry_warned", "boolean NOT NULL DEFAULT false"},
+	{"filter", "text"},
+	{"secret", "bytea"},
+}
+
+// Optional columns of the legacy webhook subscription tables.
+var legacySubscriptionColumns = []column{
+	{"failures", "integer NOT NULL DEFAULT 0"},
+	{"disabled", "boolean NOT NULL DEFAULT false"},
+	{"secret", "bytea"},
+}
+
+// Adds any optional columns which are missing from a GraphQL webhook
+// subscription table. Tables which have not been migrated may still be used,
+// but the features which depend on the missing columns are disabled. This is
+// equivalent to the following SQL, which may be used instead with your usual
+// migration tooling:
+//
+//	ALTER TABLE gql_{name}_wh_sub
+//		ADD COLUMN IF NOT EXISTS failures integer NOT NULL DEFAULT 0,
+//		ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false,
+//		ADD COLUMN IF NOT EXISTS batch_size integer,
+//		ADD COLUMN IF NOT EXISTS batch_window integer,
+//		ADD COLUMN IF NOT EXISTS expiry_warned boolean NOT NULL DEFAULT false,
+//		ADD COLUMN IF NOT EXISTS filter text,
+//		ADD COLUMN IF NOT EXISTS secret bytea;
+//
+// Name shall be the prefix of the webhook tables, e.g. "profile" for
+// "gql_profile_wh_{delivery,sub}". The columns which are present are detected
+// when the queue first uses each table, so the service must be restarted
+// after the migration for the new features to take effect.
+func MigrateSubscriptions(ctx context.Context, name string) error {
+	return migrateColumns(ctx, "gql_"+name+"_wh_sub", subscriptionColumns)
+}
+
+// Adds any optional columns which are missing from a legacy webhook
+// subscription table, as with MigrateSubscriptions. This is equivalent to the
+// following SQL:
+//
+//	ALTER TABLE {name}_webhook_subscription
+//		ADD COLUMN IF NOT EXISTS failures integer NOT NULL DEFAULT 0,
+//		ADD COLUMN IF NOT EXISTS disabled boolean NOT NULL DEFAULT false,
+//		ADD COLUMN IF NOT EXISTS secret bytea;
+//
+// Name shall be the prefix of the webhook tables, e.g. "user" for
+// "user_webhook_{delivery,subscription}".
+func MigrateLegacySubscriptions(ctx context.Context, name string) error {
+	return migrateColumns(ctx, name+"_webhook_subscription",
+		legacySubscriptionColumns)
+}
+
+func migrateColumns(ctx context.Context, table string, columns []column) error {
+	var clauses []string
+	for _, col := range columns {
+		clauses = append(clauses, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s",
+			pq.QuoteIdentifier(col.name), col.definition))
+	}
+	return database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s %s",
+			pq.QuoteIdentifier(table), strings.Join(clauses, ", "))); err != nil {
+			return err
+		}
+		log.Printf("Migrated %s webhook columns", table)
+		return nil
+	})
+}
+
+// Records which columns are present on each subscription table, and their
+// types, so that tables which have not been migrated may still be used.
+type columnCache struct {
+	mutex  sync.Mutex
+	tables map[string]map[string]string
+}
+
+func newColumnCache() *columnCache {
+	return &columnCache{tables: make(map[string]map[string]string)}
+}
+
+// Returns the set of columns present on a table, querying the database only
+// the first time each table is used.
+func (cache *columnCache) columns(ctx context.Context,
+	tx *sql.Tx, table string) (map[string]bool, error) {
+	types, err := cache.types(ctx, tx, table)
+	if err != nil {
+		return nil, err
+	}
+	cols := make(map[string]bool, len(types))
+	for name := range types {
+		cols[name] = true
+	}
+	return cols, nil
+}
+
+// Returns the data type of each column present on a table, as reported by
+// information_schema (e.g. "ARRAY" or "character varying").
+func (cache *columnCache) types(ctx context.Context,
+	tx *sql.Tx, table string) (map[string]string, error) {
+	cache.mutex.Lock()
+	types, ok := cache.tables[table]
+	cache.mutex.Unlock()
+	if ok {
+		return types, nil
+	}
+
+	rows, err := sq.
+		Select("column_name", "data_type").
+		From("information_schema.columns").
+		Where("table_schema = current_schema()").
+		Where("table_name = ?", table).
+		PlaceholderFormat(sq.Dollar).
+		RunWith(tx).
+		QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types = make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		types[name] = dataType
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	cache.mutex.Lock()
+	cache.tables[table] = types
+	cache.mutex.Unlock()
+	return types, nil
+}
@@ -0,0 +1,105 @@
+package webhooks
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+// Expects the columns of a subscription table to be looked up.
+func expectColumns(mock sqlmock.Sqlmock, table string, columns ...string) {
+	rows := sqlmock.NewRows([]string{"column_name", "data_type"})
+	for _, col := range columns {
+		// A "[]" suffix marks an array column, e.g. "events[]"
+		if name := strings.TrimSuffix(col, "[]"); name != col {
+			rows.AddRow(name, "ARRAY")
+		} else {
+			rows.AddRow(col, "character varying")
+		}
+	}
+	mock.ExpectQuery(`SELECT column_name, data_type ` +
+		`FROM information_schema.columns ` +
+		`WHERE table_schema = current_schema\(\) AND table_name = \$1`).
+		WithArgs(table).
+		WillReturnRows(rows)
+}
+
+func TestMigrateSubscriptions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE "gql_profile_wh_sub" ` +
+		`ADD COLUMN IF NOT EXISTS "failures" integer NOT NULL DEFAULT 0, ` +
+		`ADD COLUMN IF NOT EXISTS "disabled" boolean NOT NULL DEFAULT false, ` +
+		`ADD COLUMN IF NOT EXISTS "batch_size" integer, ` +
+		`ADD COLUMN IF NOT EXISTS "batch_window" integer, ` +
+		`ADD COLUMN IF NOT EXISTS "expiry_warned" boolean NOT NULL DEFAULT false, ` +
+		`ADD COLUMN IF NOT EXISTS "filter" text, ` +
+		`ADD COLUMN IF NOT EXISTS "secret" bytea`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	assert.Nil(t, MigrateSubscriptions(ctx, "profile"))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE "user_webhook_subscription" ` +
+		`ADD COLUMN IF NOT EXISTS "failures"`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+	assert.Nil(t, MigrateLegacySubscriptions(ctx, "user"))
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestUnmigratedSubscriptions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+
+	// Tables without the optional columns are queried without them
+	mock.ExpectBegin()
+	expectColumns(mock, "user_webhook_subscription",
+		"id", "created", "url", "events[]")
+	mock.ExpectQuery(`SELECT sub.id, sub.created, sub.url, sub.events `+
+		`FROM user_webhook_subscription sub `+
+		`WHERE sub.user_id = \$1 AND sub.events @> ARRAY\[\$2\]::varchar\[\]$`).
+		WithArgs(42, "profile:update").
+		WillReturnRows(sqlmock.NewRows([]string{"sub.id"}))
+	mock.ExpectCommit()
+
+	queue := NewLegacyQueue(testConfig, "test")
+	q := sq.
+		Select().
+		From("user_webhook_subscription sub").
+		Where(`sub.user_id = ?`, 42)
+	_, err = queue.fetchSubscriptions(ctx, q, "user", "profile:update")
+	assert.Nil(t, err)
+
+	// The columns are only looked up once
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM user_webhook_subscription sub`).
+		WithArgs(42, "profile:update").
+		WillReturnRows(sqlmock.NewRows([]string{"sub.id"}))
+	mock.ExpectCommit()
+	_, err = queue.fetchSubscriptions(ctx, q, "user", "profile:update")
+	assert.Nil(t, err)
+
+	// Failures are not counted
+	mock.ExpectBegin()
+	mock.ExpectCommit()
+	recordDeliveryResult(ctx, queue.columns, 0, "user_webhook_subscription",
+		1337, "https://example.org", true)
+
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,40 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/emersion/go-message/mail"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/email"
+)
+
+// Looks up the username and email address of the owner of a subscription.
+func lookupOwner(ctx context.Context, tx *sql.Tx,
+	userID int) (string, string, error) {
+	var username, address string
+	err := sq.
+		Select("username", "email").
+		From(`"user"`).
+		Where("id = ?", userID).
+		PlaceholderFormat(sq.Dollar).
+		RunWith(tx).
+		ScanContext(ctx, &username, &address)
+	return username, address, err
+}
+
+// Sends an email about one of their webhook subscriptions to its owner.
+func notifyOwner(ctx context.Context, username, address,
+	subject, body string) error {
+	var header mail.Header
+	header.SetAddressList("To", []*mail.Address{
+		{Name: "~" + username, Address: address},
+	})
+	header.SetSubject(fmt.Sprintf("[%s] %s", config.ServiceName(ctx), subject))
+	return email.EnqueueNotification(ctx, header,
+		strings.NewReader(fmt.Sprintf("~%s,\n\n%s", username, body)), nil)
+}
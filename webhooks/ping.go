@@ -0,0 +1,78 @@
+package webhooks
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+// The event name used for synthetic ping deliveries.
+const EVENT_PING = "PING"
+
+// The maximum time to wait for a receiver to respond to a ping.
+const pingTimeout = 10 * time.Second
+
+type pingPayload struct {
+	Data struct {
+		Ping struct {
+			UUID  string    `json:"uuid"`
+			Event string    `json:"event"`
+			Date  time.Time `json:"date"`
+		} `json:"ping"`
+	} `json:"data"`
+}
+
+// Delivers a signed sample payload to a single subscription so that the
+// subscriber can test their receiver URL and signature verification. The
+// delivery is recorded like any other, but is attempted only once, and the
+// receiver's response is returned to the caller.
+//
+// Name shall be the prefix of the webhook tables, e.g. "profile" for
+// "gql_profile_wh_{delivery,sub}".
+//
+// The receiver's response is returned whatever its status, and the caller
+// should check the StatusCode. An error is only returned alongside the
+// response if the status is 502, 503, or 504, which would cause other
+// deliveries to be retried.
+func (queue *WebhookQueue) Ping(ctx context.Context, name string,
+	sub *WebhookSubscription) (*DeliveryResponse, error) {
+	webhook := WebhookContext{
+		Name:         name,
+		Event:        EVENT_PING,
+		PayloadUUID:  uuid.New(),
+		Subscription: sub,
+	}
+
+	var sample pingPayload
+	sample.Data.Ping.UUID = webhook.PayloadUUID.String()
+	sample.Data.Ping.Event = EVENT_PING
+	sample.Data.Ping.Date = time.Now().UTC()
+	payload, err := json.Marshal(&sample)
+	if err != nil {
+		panic(err)
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Type", "application/json")
+	headers.Set("X-Webhook-Event", webhook.Event)
+	headers.Set("X-Webhook-Delivery", webhook.PayloadUUID.String())
+
+	var deliveryID int
+	if err := database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+		var err error
+		deliveryID, err = insertDelivery(ctx, tx, &webhook, payload)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	return queue.deliverPayload(ctx, &webhook, headers, payload, deliveryID)
+}
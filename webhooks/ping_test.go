@@ -0,0 +1,72 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/config"
+	"git.sr.ht/~sircmpwn/core-go/crypto"
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+func TestPing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			defer r.Body.Close()
+
+			assert.Equal(t, EVENT_PING, r.Header.Get("X-Webhook-Event"))
+			assert.NotEqual(t, "", r.Header.Get("X-Webhook-Delivery"))
+
+			b, err := ioutil.ReadAll(r.Body)
+			assert.Nil(t, err)
+
+			var payload pingPayload
+			assert.Nil(t, json.Unmarshal(b, &payload))
+			assert.Equal(t, EVENT_PING, payload.Data.Ping.Event)
+			assert.Equal(t, r.Header.Get("X-Webhook-Delivery"),
+				payload.Data.Ping.UUID)
+
+			nonce := r.Header.Get("X-Payload-Nonce")
+			signature := r.Header.Get("X-Payload-Signature")
+			assert.True(t, crypto.VerifyWebhook(b, nonce, signature))
+
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte("Pong!"))
+		}))
+	defer srv.Close()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := config.Context(context.Background(), testConfig, "test")
+	ctx = database.Context(ctx, db)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO gql_profile_wh_delivery`).
+		WithArgs(sqlmock.AnyArg(), EVENT_PING, 1337, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4096))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE gql_profile_wh_delivery`).
+		WithArgs("Pong!", http.StatusAccepted, sqlmock.AnyArg(), 4096).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	queue := NewQueue(nil, testConfig, "test")
+	resp, err := queue.Ping(ctx, "profile", &WebhookSubscription{
+		ID:  1337,
+		URL: srv.URL + "/webhook",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t, []byte("Pong!"), resp.Body)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,115 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+
+	work "git.sr.ht/~sircmpwn/dowork"
+)
+
+// Distributes webhook deliveries across a number of work queues, each of which
+// attempts its tasks serially. Each delivery is placed on the least busy
+// queue, and deliveries to a single destination host may be limited to a
+// subset of the queues, so that a slow receiver cannot hold up deliveries to
+// everyone else.
+type deliveryPool struct {
+	mutex   sync.Mutex
+	queues  []*work.Queue
+	pending []int
+	hosts   map[string]map[int]int
+	perHost int
+}
+
+// Creates a delivery pool which uses the given queue, plus workers-1
+// additional queues. Deliveries to one host will use at most perHost queues,
+// or any number of queues if perHost is zero.
+func newDeliveryPool(queue *work.Queue, name string,
+	workers, perHost int) *deliveryPool {
+	if workers < 1 || perHost < 0 {
+		panic(fmt.Errorf("Invalid webhook delivery concurrency"))
+	}
+	queues := []*work.Queue{queue}
+	for i := 1; i < workers; i++ {
+		queues = append(queues, work.NewQueue(fmt.Sprintf("%s_%d", name, i)))
+	}
+	return &deliveryPool{
+		queues:  queues,
+		pending: make([]int, workers),
+		hosts:   make(map[string]map[int]int),
+		perHost: perHost,
+	}
+}
+
+// Returns a new delivery task for the given destination URL, which should
+// be enqueued with Enqueue.
+func (pool *deliveryPool) NewTask(dest string, fn work.TaskFunc,
+	after func(ctx context.Context, task *work.Task)) *work.Task {
+	task := work.NewTask(fn).Retries(5).After(
+		func(ctx context.Context, task *work.Task) {
+			pool.release(task)
+			after(ctx, task)
+		})
+	var host string
+	if u, err := url.Parse(dest); err == nil {
+		host = u.Host
+	}
+	task.Metadata["host"] = host
+	return task
+}
+
+// Enqueues a task created with NewTask on the least busy queue which is
+// available for its destination host. Other tasks are enqueued on the first
+// queue, and do not count towards the limits.
+func (pool *deliveryPool) Enqueue(task *work.Task) {
+	host, ok := task.Metadata["host"].(string)
+	if !ok {
+		pool.queues[0].Enqueue(task)
+		return
+	}
+
+	pool.mutex.Lock()
+	shards, ok := pool.hosts[host]
+	if !ok {
+		shards = make(map[int]int)
+		pool.hosts[host] = shards
+	}
+	shard := -1
+	for i := range pool.queues {
+		if _, ok := shards[i]; !ok &&
+			pool.perHost != 0 && len(shards) >= pool.perHost {
+			continue
+		}
+		if shard == -1 || pool.pending[i] < pool.pending[shard] {
+			shard = i
+		}
+	}
+	shards[shard]++
+	pool.pending[shard]++
+	task.Metadata["shard"] = shard
+	pool.mutex.Unlock()
+
+	pool.queues[shard].Enqueue(task)
+}
+
+func (pool *deliveryPool) release(task *work.Task) {
+	host := task.Metadata["host"].(string)
+	shard := task.Metadata["shard"].(int)
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	pool.pending[shard]--
+	shards := pool.hosts[host]
+	if shards[shard]--; shards[shard] == 0 {
+		delete(shards, shard)
+	}
+	if len(shards) == 0 {
+		delete(pool.hosts, host)
+	}
+}
+
+// Returns all of the work queues used by this pool.
+func (pool *deliveryPool) Queues() []*work.Queue {
+	return pool.queues
+}
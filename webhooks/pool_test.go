@@ -0,0 +1,55 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	work "git.sr.ht/~sircmpwn/dowork"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryPool(t *testing.T) {
+	pool := newDeliveryPool(work.NewQueue("test"), "test", 3, 1)
+	assert.Len(t, pool.Queues(), 3)
+
+	noop := func(ctx context.Context) error { return nil }
+	after := func(ctx context.Context, task *work.Task) {}
+
+	// A single host is restricted to one queue
+	var slow []*work.Task
+	for i := 0; i < 3; i++ {
+		task := pool.NewTask("https://slow.example.org/hook", noop, after)
+		pool.Enqueue(task)
+		slow = append(slow, task)
+	}
+	for _, task := range slow {
+		assert.Equal(t, 0, task.Metadata["shard"])
+	}
+
+	// Other hosts use the least busy queues
+	a := pool.NewTask("https://a.example.org/hook", noop, after)
+	pool.Enqueue(a)
+	b := pool.NewTask("https://b.example.org/hook", noop, after)
+	pool.Enqueue(b)
+	assert.Equal(t, 1, a.Metadata["shard"])
+	assert.Equal(t, 2, b.Metadata["shard"])
+
+	// Completed tasks release their queue
+	ctx := context.Background()
+	pool.Queues()[0].Dispatch(ctx)
+	assert.Equal(t, 0, pool.pending[0])
+	assert.NotContains(t, pool.hosts, "slow.example.org")
+
+	c := pool.NewTask("https://c.example.org/hook", noop, after)
+	pool.Enqueue(c)
+	assert.Equal(t, 0, c.Metadata["shard"])
+
+	// Tasks which were not created with NewTask use the first queue
+	d := work.NewTask(noop)
+	pool.Enqueue(d)
+	assert.NotContains(t, d.Metadata, "shard")
+	assert.Equal(t, 1, pool.pending[0])
+	pool.Queues()[0].Dispatch(ctx)
+	assert.True(t, d.Done())
+	assert.Equal(t, 0, pool.pending[0])
+}
@@ -4,18 +4,21 @@ import (
 	"bytes"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	work "git.sr.ht/~sircmpwn/dowork"
 	"github.com/99designs/gqlgen/graphql"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/vaughan0/go-ini"
 
 	"git.sr.ht/~sircmpwn/core-go/auth"
 	"git.sr.ht/~sircmpwn/core-go/crypto"
@@ -25,12 +28,23 @@ import (
 type WebhookQueue struct {
 	Queue  *work.Queue
 	Schema graphql.ExecutableSchema
+
+	pool        *deliveryPool
+	columns     *columnCache
+	maxFailures int
+	policy      *addressPolicy
+	snapshots   bool
+	legacy      *LegacyQueue
+	adapters    map[string]LegacyAdapter
+	batches     map[string]*batch
+	batchMutex  sync.Mutex
 }
 
 type WebhookSubscription struct {
-	ID    int
-	URL   string
-	Query string
+	ID     int
+	UserID int
+	URL    string
+	Query  string
 	// See AuthConfig in webhooks/config.go for an explanation of these fields
 	AuthMethod string
 	TokenHash  *string
@@ -38,12 +52,54 @@ type WebhookSubscription struct {
 	ClientID   *string
 	Expires    *time.Time
 	NodeID     *string
+	// See batch.go; nil if batching is not enabled
+	BatchSize   *int
+	BatchWindow *int
+	// See filter.go; nil if all events are delivered
+	Filter *string
+	// See secret.go; nil if the subscription has no secret
+	Secret []byte
 }
 
 // Creates a new worker for delivering webhooks. The caller must start the
-// worker themselves.
-func NewQueue(schema graphql.ExecutableSchema) *WebhookQueue {
-	return &WebhookQueue{work.NewQueue("webhooks"), schema}
+// worker themselves. The [webhooks] settings and the service's internal
+// networks are read from the config, and the service fails to start if they
+// are invalid.
+func NewQueue(schema graphql.ExecutableSchema,
+	conf ini.File, service string) *WebhookQueue {
+	queue := work.NewQueue("webhooks")
+	return &WebhookQueue{
+		Queue:       queue,
+		Schema:      schema,
+		pool:        newDeliveryPool(queue, "webhooks", 1, 0),
+		columns:     newColumnCache(),
+		maxFailures: loadMaxFailures(conf),
+		policy:      loadAddressPolicy(conf, service),
+		batches:     make(map[string]*batch),
+	}
+}
+
+// Configures the number of workers which deliver webhooks concurrently, and
+// the maximum number of those workers which may be used for deliveries to a
+// single host (or zero for no limit). This must be called before the worker is
+// started, and the caller must start all of the queues returned by Queues.
+func (queue *WebhookQueue) WithConcurrency(workers, perHost int) *WebhookQueue {
+	queue.pool = newDeliveryPool(queue.Queue, "webhooks", workers, perHost)
+	return queue
+}
+
+// Configures the worker to execute webhook queries when the webhook is
+// scheduled, rather than when the worker gets around to it, so that each
+// payload describes the state at the time of the event. This moves the cost of
+// executing the queries into the caller of Schedule.
+func (queue *WebhookQueue) WithSnapshots() *WebhookQueue {
+	queue.snapshots = true
+	return queue
+}
+
+// Returns all of the work queues used by this worker.
+func (queue *WebhookQueue) Queues() []*work.Queue {
+	return queue.pool.Queues()
 }
 
 // Schedules delivery of a webhook to a set of subscribers.
@@ -60,13 +116,22 @@ func NewQueue(schema graphql.ExecutableSchema) *WebhookQueue {
 // The context should NOT be the context used to service the HTTP request which
 // initiated the webhook delivery. It should instead be a fresh background
 // context which contains the necessary state for your application to process
-// the webhook resolvers.
+// the webhook resolvers. The webhook queries are executed later by the worker,
+// using this context, so the payload must not be modified after this call,
+// unless the queue was configured WithSnapshots.
+//
+// If a legacy adapter has been configured for this event with BridgeLegacy,
+// the legacy webhook is scheduled as well.
 func (queue *WebhookQueue) Schedule(ctx context.Context, q sq.SelectBuilder,
 	name, event string, payloadUUID uuid.UUID, payload interface{}) {
 	err := queue.schedule(ctx, q, name, event, payloadUUID, payload)
 	if err != nil {
 		log.Printf("Failed to enqueue webhook deliveries: %v", err)
 	}
+	err = queue.scheduleLegacy(ctx, event, payload)
+	if err != nil {
+		log.Printf("Failed to enqueue legacy webhook deliveries: %v", err)
+	}
 }
 
 func (queue *WebhookQueue) schedule(ctx context.Context, q sq.SelectBuilder,
@@ -74,14 +139,15 @@ func (queue *WebhookQueue) schedule(ctx context.Context, q sq.SelectBuilder,
 	// The following tasks are done during this process:
 	//
 	// 1. Fetch subscription details from the database
-	// 2. Prepare deliveries and create delivery records
-	// 3. Deliver the webhooks
+	// 2. Execute the webhook queries
+	// 3. Create delivery records
+	// 4. Deliver the webhooks
 	//
-	// The first two steps are done synchronously, then N tasks are created for
-	// step 3 where N = number of subscriptions.
-	user := auth.ForContext(ctx)
+	// The first step is done synchronously, as is the second if snapshots are
+	// enabled. The remaining steps are done in a task, which creates N tasks
+	// for step 4 where N = number of subscriptions.
 	ctx = Context(ctx, payload)
-	subs, err := queue.fetchSubscriptions(ctx, q, event)
+	subs, err := queue.fetchSubscriptions(ctx, q, name, event)
 	if err != nil {
 		return err
 	}
@@ -89,53 +155,148 @@ func (queue *WebhookQueue) schedule(ctx context.Context, q sq.SelectBuilder,
 		return nil
 	}
 
-	tasks := make([]*work.Task, len(subs))
-	if err := database.WithTx(ctx, nil, func(tx *sql.Tx) error {
-		var err error
-		for i, sub := range subs {
-			webhook := WebhookContext{
-				Name:         name,
-				Event:        event,
-				User:         user,
-				Payload:      payload,
-				PayloadUUID:  payloadUUID,
-				Subscription: sub,
-			}
-			tasks[i], err = queue.queueStage2(ctx, tx, &webhook)
-			if err != nil {
-				return err
-			}
+	// The auth context may be modified by the caller after we return
+	user := *auth.ForContext(ctx)
+	var webhooks []*WebhookContext
+	for _, sub := range subs {
+		webhooks = append(webhooks, &WebhookContext{
+			Name:         name,
+			Event:        event,
+			User:         &user,
+			Payload:      payload,
+			PayloadUUID:  payloadUUID,
+			Subscription: sub,
+		})
+	}
+
+	var results []*execution
+	if queue.snapshots {
+		results = queue.execute(ctx, webhooks)
+	}
+	task := work.NewTask(func(_ context.Context) error {
+		// The caller's context is used rather than the worker's, because it
+		// contains the state necessary to process the webhook resolvers
+		if results == nil {
+			results = queue.execute(ctx, webhooks)
 		}
+		queue.prepare(ctx, results)
 		return nil
-	}); err != nil {
-		log.Printf("Failed to enqueue %s/%s webhooks: %v", name, event, err)
-		return err
+	})
+	return queue.Queue.Enqueue(task)
+}
+
+// The result of executing the query for a single subscription.
+type execution struct {
+	webhook *WebhookContext
+	payload []byte
+	err     error
+}
+
+// Executes the webhook query for each subscription.
+func (queue *WebhookQueue) execute(ctx context.Context,
+	webhooks []*WebhookContext) []*execution {
+	var results []*execution
+	for _, webhook := range webhooks {
+		payload, err := webhook.Exec(ctx, queue.Schema)
+		results = append(results, &execution{
+			webhook: webhook,
+			payload: payload,
+			err:     err,
+		})
 	}
+	return results
+}
 
-	for _, task := range tasks {
-		queue.Queue.Enqueue(task)
+// Returns false if the subscription's filter excludes the query result.
+// Queries which failed are always recorded.
+func (result *execution) match() (bool, error) {
+	sub := result.webhook.Subscription
+	if result.err != nil || sub.Filter == nil {
+		return true, nil
+	}
+	filter, err := ParseFilter(*sub.Filter)
+	if err != nil {
+		return false, &filterError{err}
 	}
-	log.Printf("Enqueued %s/%s webhook delivery for %d subscriptions",
-		name, event, len(subs))
-	return nil
+	match, err := filter.Match(result.payload)
+	if err != nil {
+		return false, &filterError{err}
+	}
+	return match, nil
+}
+
+// Creates the delivery record for each executed webhook query, and enqueues
+// the deliveries.
+func (queue *WebhookQueue) prepare(ctx context.Context, results []*execution) {
+	// Each subscription is prepared in its own transaction, so that a failure
+	// for one subscriber does not prevent delivery to the others
+	var enqueued int
+	for _, result := range results {
+		if match, err := result.match(); err != nil {
+			// Recorded in place of the delivery by queueStage2
+			result.err = err
+		} else if !match {
+			continue
+		}
+
+		var d *delivery
+		if err := database.WithTx(ctx, nil, func(tx *sql.Tx) error {
+			var err error
+			d, err = queue.queueStage2(ctx, tx, result)
+			return err
+		}); err != nil {
+			log.Printf("Failed to enqueue %s/%s webhook for subscription %d: %v",
+				result.webhook.Name, result.webhook.Event,
+				result.webhook.Subscription.ID, err)
+			continue
+		}
+		if d != nil {
+			queue.enqueue(d)
+			enqueued++
+		}
+	}
+
+	webhook := results[0].webhook
+	log.Printf("Enqueued %s/%s webhook delivery for %d of %d subscriptions",
+		webhook.Name, webhook.Event, enqueued, len(results))
 }
 
 func (queue *WebhookQueue) fetchSubscriptions(ctx context.Context,
-	q sq.SelectBuilder, event string) ([]*WebhookSubscription, error) {
+	q sq.SelectBuilder, name, event string) ([]*WebhookSubscription, error) {
 	var subs []*WebhookSubscription
 	if err := database.WithTx(ctx, &sql.TxOptions{
 		Isolation: 0,
 		ReadOnly:  true,
 	}, func(tx *sql.Tx) error {
-		var (
-			err  error
-			rows *sql.Rows
-		)
+		cols, err := queue.columns.columns(ctx, tx, "gql_"+name+"_wh_sub")
+		if err != nil {
+			return err
+		}
+		if cols["disabled"] {
+			q = q.Where("NOT sub.disabled")
+		}
+
+		q = q.Columns("sub.id", "sub.user_id", "sub.url", "sub.query",
+			"sub.auth_method",
+			"sub.token_hash", "sub.grants", "sub.client_id", "sub.expires",
+			"sub.node_id")
+		// Secrets, filters, and batching are only available if the table has
+		// been migrated
+		secrets := cols["secret"]
+		if secrets {
+			q = q.Columns("sub.secret")
+		}
+		filtering := cols["filter"]
+		if filtering {
+			q = q.Columns("sub.filter")
+		}
+		batching := cols["batch_size"] && cols["batch_window"]
+		if batching {
+			q = q.Columns("sub.batch_size", "sub.batch_window")
+		}
+
+		var rows *sql.Rows
 		if rows, err = q.
-			Columns("sub.id", "sub.url", "sub.query",
-				"sub.auth_method",
-				"sub.token_hash", "sub.grants", "sub.client_id", "sub.expires",
-				"sub.node_id").
 			Where("? = ANY(sub.events)", event).
 			PlaceholderFormat(sq.Dollar).
 			RunWith(tx).
@@ -146,36 +307,136 @@ func (queue *WebhookQueue) fetchSubscriptions(ctx context.Context,
 
 		for rows.Next() {
 			var sub WebhookSubscription
-			if err := rows.Scan(&sub.ID, &sub.URL, &sub.Query,
+			dest := []interface{}{&sub.ID, &sub.UserID, &sub.URL, &sub.Query,
 				&sub.AuthMethod,
 				&sub.TokenHash, &sub.Grants, &sub.ClientID, &sub.Expires,
-				&sub.NodeID); err != nil {
-				panic(err)
+				&sub.NodeID}
+			if secrets {
+				dest = append(dest, &sub.Secret)
+			}
+			if filtering {
+				dest = append(dest, &sub.Filter)
+			}
+			if batching {
+				dest = append(dest, &sub.BatchSize, &sub.BatchWindow)
+			}
+			if err := rows.Scan(dest...); err != nil {
+				return err
 			}
 			subs = append(subs, &sub)
 		}
 
-		return nil
+		return rows.Err()
 	}); err != nil {
 		return nil, err
 	}
 	return subs, nil
 }
 
+// A delivery which has been recorded in the database, but not yet performed.
+type delivery struct {
+	webhook    *WebhookContext
+	headers    http.Header
+	payload    []byte
+	deliveryID int
+}
+
+// Inserts the delivery record for an executed webhook query
 func (queue *WebhookQueue) queueStage2(ctx context.Context,
-	tx *sql.Tx, webhook *WebhookContext) (*work.Task, error) {
+	tx *sql.Tx, result *execution) (*delivery, error) {
+	webhook := result.webhook
 	headers := make(http.Header)
 	headers.Set("Content-Type", "application/json")
 	headers.Set("X-Webhook-Event", webhook.Event)
 	headers.Set("X-Webhook-Delivery", webhook.PayloadUUID.String())
 
-	payload, err := webhook.Exec(ctx, queue.Schema)
+	// Deliveries which cannot be performed are recorded so that the
+	// subscriber can find out why they are not receiving webhooks
+	payload, err := result.payload, result.err
+	var (
+		qerr *QueryError
+		ferr *filterError
+	)
+	if errors.Is(err, auth.ErrWebhookTokenExpired) {
+		// This is only recorded once, rather than for every event until the
+		// subscription is rebound
+		if skipped, err := skippedSince(ctx, tx, webhook,
+			STATUS_TOKEN_EXPIRED, *webhook.Subscription.Expires); err != nil {
+			return nil, err
+		} else if skipped {
+			return nil, nil
+		}
+		return nil, insertSkippedDelivery(ctx, tx, webhook,
+			STATUS_TOKEN_EXPIRED, err.Error())
+	} else if errors.As(err, &qerr) {
+		body, err := qerr.Response()
+		if err != nil {
+			return nil, err
+		}
+		return nil, insertSkippedDelivery(ctx, tx, webhook,
+			STATUS_QUERY_ERROR, string(body))
+	} else if errors.As(err, &ferr) {
+		return nil, insertSkippedDelivery(ctx, tx, webhook,
+			STATUS_FILTER_ERROR, ferr.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	deliveryID, err := insertDelivery(ctx, tx, webhook, payload)
 	if err != nil {
 		return nil, err
 	}
 
+	return &delivery{
+		webhook:    webhook,
+		headers:    headers,
+		payload:    payload,
+		deliveryID: deliveryID,
+	}, nil
+}
+
+// Schedules a recorded delivery, which must have been committed to the
+// database.
+func (queue *WebhookQueue) enqueue(d *delivery) {
+	if d.webhook.Subscription.batched() {
+		queue.enqueueBatched(d)
+		return
+	}
+
+	webhook := d.webhook
+	var resp *DeliveryResponse
+	deliver := func(ctx context.Context) error {
+		var err error
+		resp, err = queue.deliverPayload(ctx, webhook,
+			d.headers, d.payload, d.deliveryID)
+		return err
+	}
+	queue.pool.Enqueue(queue.pool.NewTask(webhook.Subscription.URL, deliver,
+		func(ctx context.Context, task *work.Task) {
+			if task.Result() == nil {
+				log.Printf("%s: webhook delivery complete after %d attempts",
+					webhook.PayloadUUID, task.Attempts())
+			} else {
+				log.Printf("%s: webhook delivery failed after %d attempts: %v",
+					webhook.PayloadUUID, task.Attempts(), task.Result())
+			}
+			recordDeliveryResult(ctx, queue.columns, queue.maxFailures,
+				"gql_"+webhook.Name+"_wh_sub", webhook.Subscription.ID,
+				webhook.Subscription.URL, deliveryFailed(task, resp))
+		}))
+}
+
+// Returns true if a completed delivery task should count as a failure
+func deliveryFailed(task *work.Task, resp *DeliveryResponse) bool {
+	return task.Result() != nil || resp == nil ||
+		resp.StatusCode < 200 || resp.StatusCode >= 300
+}
+
+// Inserts the delivery record for a webhook and returns its ID
+func insertDelivery(ctx context.Context, tx *sql.Tx,
+	webhook *WebhookContext, payload []byte) (int, error) {
 	var deliveryID int
-	err = sq.
+	err := sq.
 		Insert("gql_"+webhook.Name+"_wh_delivery").
 		Columns("uuid", "date", "event", "subscription_id", "request_body").
 		Values(webhook.PayloadUUID, sq.Expr("NOW() at time zone 'utc'"),
@@ -184,37 +445,77 @@ func (queue *WebhookQueue) queueStage2(ctx context.Context,
 		PlaceholderFormat(sq.Dollar).
 		RunWith(tx).
 		ScanContext(ctx, &deliveryID)
-	if err != nil {
-		return nil, err
+	return deliveryID, err
+}
+
+// Values for the response_status of delivery records which were not sent to
+// the receiver. These are negative so that they are not mistaken for HTTP
+// status codes.
+const (
+	STATUS_TOKEN_EXPIRED = -(iota + 1)
+	STATUS_QUERY_ERROR
+	STATUS_FILTER_ERROR
+)
+
+// Inserts a record for a delivery which was skipped, with the reason stored
+// as the response body.
+func insertSkippedDelivery(ctx context.Context, tx *sql.Tx,
+	webhook *WebhookContext, status int, reason string) error {
+	_, err := sq.
+		Insert("gql_"+webhook.Name+"_wh_delivery").
+		Columns("uuid", "date", "event", "subscription_id", "request_body",
+			"response_status", "response_body").
+		Values(webhook.PayloadUUID, sq.Expr("NOW() at time zone 'utc'"),
+			webhook.Event, webhook.Subscription.ID, "",
+			status, reason).
+		PlaceholderFormat(sq.Dollar).
+		RunWith(tx).
+		ExecContext(ctx)
+	return err
+}
+
+// Returns true if a delivery to this subscription has been skipped with the
+// given status since the given time.
+func skippedSince(ctx context.Context, tx *sql.Tx,
+	webhook *WebhookContext, status int, since time.Time) (bool, error) {
+	var id int
+	err := sq.
+		Select("id").
+		From("gql_"+webhook.Name+"_wh_delivery").
+		Where("subscription_id = ?", webhook.Subscription.ID).
+		Where("response_status = ?", status).
+		Where("date >= ?", since).
+		Limit(1).
+		PlaceholderFormat(sq.Dollar).
+		RunWith(tx).
+		ScanContext(ctx, &id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil {
+		return false, err
 	}
+	return true, nil
+}
 
-	return work.NewTask(func(ctx context.Context) error {
-		return queue.deliverPayload(ctx, webhook, headers, payload, deliveryID)
-	}).Retries(5).After(func(ctx context.Context, task *work.Task) {
-		if task.Result() == nil {
-			log.Printf("%s: webhook delivery complete after %d attempts",
-				webhook.PayloadUUID, task.Attempts())
-		} else {
-			log.Printf("%s: webhook delivery failed after %d attempts: %v",
-				webhook.PayloadUUID, task.Attempts(), task.Result())
-		}
-	}), nil
+// The response from the receiver of a webhook delivery.
+type DeliveryResponse struct {
+	StatusCode int
+	Headers    http.Header
+	Body       []byte
 }
 
-// Performs a webhook delivery and updates the delivery record in the database
+// Performs a webhook delivery and updates the delivery records in the database
 func (queue *WebhookQueue) deliverPayload(ctx context.Context,
 	webhook *WebhookContext, headers http.Header, payload []byte,
-	deliveryID int) error {
+	deliveryIDs ...int) (*DeliveryResponse, error) {
 
-	client := &http.Client{
-		Timeout: 30 * time.Second,
-	}
+	client := deliveryClient(queue.policy)
 	rctx, cancel := context.WithDeadline(ctx, time.Now().Add(30*time.Second))
 	req, err := http.NewRequestWithContext(rctx,
 		http.MethodPost, webhook.Subscription.URL, bytes.NewReader(payload))
 	defer cancel()
 	if err != nil {
-		return fmt.Errorf("http.NewRequestWithContext: %v: %w",
+		return nil, fmt.Errorf("http.NewRequestWithContext: %v: %w",
 			err, work.ErrDoNotReattempt)
 	}
 
@@ -227,20 +528,32 @@ func (queue *WebhookQueue) deliverPayload(ctx context.Context,
 	nonce, sig := crypto.SignWebhook(payload)
 	req.Header.Add("X-Payload-Nonce", nonce)
 	req.Header.Add("X-Payload-Signature", sig)
+	err = signWithSecret(req.Header, webhook.Subscription.Secret, payload)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %w", err, work.ErrDoNotReattempt)
+	}
 
 	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	if errors.Is(err, ErrForbiddenAddress) {
+		return nil, fmt.Errorf("%v: %w", err, work.ErrDoNotReattempt)
+	} else if err != nil {
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	reader := io.LimitReader(resp.Body, 262144) // No more than 256 KiB
 	body, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return fmt.Errorf("Error reading response body: %v: %w",
+		return nil, fmt.Errorf("Error reading response body: %v: %w",
 			err, work.ErrDoNotReattempt)
 	}
 
+	response := &DeliveryResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Header,
+		Body:       body,
+	}
+
 	if err = database.WithTx(ctx, nil, func(tx *sql.Tx) error {
 		var theirs strings.Builder
 		resp.Header.Write(&theirs)
@@ -249,7 +562,7 @@ func (queue *WebhookQueue) deliverPayload(ctx context.Context,
 			Set("response_body", string(body)).
 			Set("response_status", resp.StatusCode).
 			Set("response_headers", theirs.String()).
-			Where("id = ?", deliveryID).
+			Where(sq.Eq{"id": deliveryIDs}).
 			PlaceholderFormat(sq.Dollar).
 			RunWith(tx).
 			ExecContext(ctx)
@@ -262,9 +575,9 @@ func (queue *WebhookQueue) deliverPayload(ctx context.Context,
 		resp.StatusCode == http.StatusServiceUnavailable ||
 		resp.StatusCode == http.StatusGatewayTimeout {
 		// Retry
-		return fmt.Errorf("Server returned status %d: %s",
+		return response, fmt.Errorf("Server returned status %d: %s",
 			resp.StatusCode, resp.Status)
 	}
 
-	return nil
+	return response, nil
 }
@@ -0,0 +1,274 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+	"github.com/DATA-DOG/go-sqlmock"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+
+	"git.sr.ht/~sircmpwn/core-go/auth"
+	"git.sr.ht/~sircmpwn/core-go/database"
+)
+
+func TestScheduleDefersExecution(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+	ctx = auth.InternalWebhookAuth(ctx, &auth.AuthContext{
+		UserID:   42,
+		Username: "jdoe",
+	}, "meta.sr.ht", "test")
+
+	// Only the subscriptions are fetched before Schedule returns
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub",
+		"failures", "disabled", "secret")
+	mock.ExpectQuery(`SELECT .* FROM gql_profile_wh_sub sub `+
+		`WHERE sub.user_id = \$1 AND NOT sub.disabled`).
+		WithArgs(42, "PROFILE_UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"sub.id", "sub.user_id", "sub.url", "sub.query", "sub.auth_method",
+			"sub.token_hash", "sub.grants", "sub.client_id", "sub.expires",
+			"sub.node_id", "sub.secret",
+		}).AddRow(1337, 42, "https://example.org/webhook",
+			"query { me { id } }", auth.AUTH_INTERNAL,
+			nil, nil, "meta.sr.ht", nil, "test", nil))
+	mock.ExpectCommit()
+
+	queue := NewQueue(nil, testConfig, "test")
+	q := sq.
+		Select().
+		From("gql_profile_wh_sub sub").
+		Where(`sub.user_id = ?`, 42)
+	err = queue.schedule(ctx, q, "profile", "PROFILE_UPDATE",
+		uuid.New(), struct{}{})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestScheduleSnapshot(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := database.Context(context.Background(), db)
+	ctx = auth.InternalWebhookAuth(ctx, &auth.AuthContext{
+		UserID:   42,
+		Username: "jdoe",
+	}, "meta.sr.ht", "test")
+
+	tokenHash := strings.Repeat("00", 64)
+	grants := ""
+	expires := time.Now().UTC().Add(-time.Hour)
+	mock.ExpectBegin()
+	expectColumns(mock, "gql_profile_wh_sub",
+		"failures", "disabled", "secret")
+	mock.ExpectQuery(`SELECT .* FROM gql_profile_wh_sub sub`).
+		WithArgs(42, "PROFILE_UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"sub.id", "sub.user_id", "sub.url", "sub.query", "sub.auth_method",
+			"sub.token_hash", "sub.grants", "sub.client_id", "sub.expires",
+			"sub.node_id", "sub.secret",
+		}).AddRow(1337, 42, "https://example.org/webhook",
+			"query { me { id } }", auth.AUTH_OAUTH2,
+			tokenHash, grants, nil, expires, nil, nil))
+	mock.ExpectCommit()
+
+	queue := NewQueue(nil, testConfig, "test").WithSnapshots()
+	q := sq.
+		Select().
+		From("gql_profile_wh_sub sub").
+		Where(`sub.user_id = ?`, 42)
+	err = queue.schedule(ctx, q, "profile", "PROFILE_UPDATE",
+		uuid.New(), struct{}{})
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// The result of the query executed at schedule time is recorded
+	mock.ExpectBegin()
+	expectSkipped(mock, sqlmock.NewRows([]string{"id"}))
+	mock.ExpectExec(`INSERT INTO gql_profile_wh_delivery`).
+		WithArgs(sqlmock.AnyArg(), "PROFILE_UPDATE", 1337, "",
+			STATUS_TOKEN_EXPIRED, auth.ErrWebhookTokenExpired.Error()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	queue.Queue.Dispatch(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// The expired token is only recorded once
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT .* FROM gql_profile_wh_sub sub`).
+		WithArgs(42, "PROFILE_UPDATE").
+		WillReturnRows(sqlmock.NewRows([]string{
+			"sub.id", "sub.user_id", "sub.url", "sub.query", "sub.auth_method",
+			"sub.token_hash", "sub.grants", "sub.client_id", "sub.expires",
+			"sub.node_id", "sub.secret",
+		}).AddRow(1337, 42, "https://example.org/webhook",
+			"query { me { id } }", auth.AUTH_OAUTH2,
+			tokenHash, grants, nil, expires, nil, nil))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	expectSkipped(mock, sqlmock.NewRows([]string{"id"}).AddRow(4096))
+	mock.ExpectCommit()
+	err = queue.schedule(ctx, q, "profile", "PROFILE_UPDATE",
+		uuid.New(), struct{}{})
+	assert.Nil(t, err)
+	queue.Queue.Dispatch(ctx)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+// Expects a search for an earlier delivery to subscription 1337 which was
+// skipped because its token expired.
+func expectSkipped(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`SELECT id FROM gql_profile_wh_delivery `+
+		`WHERE subscription_id = \$1 AND response_status = \$2 `+
+		`AND date >= \$3 LIMIT 1`).
+		WithArgs(1337, STATUS_TOKEN_EXPIRED, sqlmock.AnyArg()).
+		WillReturnRows(rows)
+}
+
+func TestPrepareSubscriptions(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		panic(err)
+	}
+	ctx := execContext(database.Context(context.Background(), db))
+
+	user := &auth.AuthContext{UserID: 42, Username: "jdoe"}
+	clientID, nodeID := "meta.sr.ht", "test"
+	var webhooks []*WebhookContext
+	for i, query := range []string{
+		"mutation { deleteUser { username } }",
+		"query { me { username } }",
+		"query { me { username } }",
+	} {
+		webhooks = append(webhooks, &WebhookContext{
+			Name:        "profile",
+			Event:       "PROFILE_UPDATE",
+			User:        user,
+			PayloadUUID: uuid.New(),
+			Subscription: &WebhookSubscription{
+				ID:         1337 + i,
+				UserID:     42,
+				URL:        "https://example.org/webhook",
+				Query:      query,
+				AuthMethod: auth.AUTH_INTERNAL,
+				ClientID:   &clientID,
+				NodeID:     &nodeID,
+			},
+		})
+	}
+
+	queue := NewQueue(testSchema(), testConfig, "test")
+	results := queue.execute(ctx, webhooks)
+	var qerr *QueryError
+	assert.True(t, errors.As(results[0].err, &qerr))
+	response, err := qerr.Response()
+	assert.Nil(t, err)
+	assert.Contains(t, string(response), "webhook operations must be queries")
+
+	// Queries which cannot be executed are recorded for the subscriber
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO gql_profile_wh_delivery`).
+		WithArgs(webhooks[0].PayloadUUID, "PROFILE_UPDATE", 1337, "",
+			STATUS_QUERY_ERROR, string(response)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+	// Each subscription is recorded in its own transaction, so a failure for
+	// one does not affect the others
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO gql_profile_wh_delivery`).
+		WithArgs(webhooks[1].PayloadUUID, "PROFILE_UPDATE", 1338,
+			`{"data":{"me":{"username":"jdoe","authMethod":"INTERNAL"}}}`).
+		WillReturnError(errors.New("connection reset"))
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO gql_profile_wh_delivery`).
+		WithArgs(webhooks[2].PayloadUUID, "PROFILE_UPDATE", 1339,
+			`{"data":{"me":{"username":"jdoe","authMethod":"INTERNAL"}}}`).
+		WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4096))
+	mock.ExpectCommit()
+	queue.prepare(ctx, results)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestSnapshotPayload(t *testing.T) {
+	type profile struct {
+		Username string
+	}
+	schema := *testSchema().(*graphql.ExecutableSchemaMock)
+	schema.ExecFunc = func(ctx context.Context) graphql.ResponseHandler {
+		return func(ctx context.Context) *graphql.Response {
+			payload, err := Payload(ctx)
+			if err != nil {
+				panic(err)
+			}
+			return &graphql.Response{Data: json.RawMessage(fmt.Sprintf(
+				`{"me":{"username":%q}}`, payload.(*profile).Username))}
+		}
+	}
+
+	for _, snapshots := range []bool{true, false} {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			panic(err)
+		}
+		ctx := execContext(database.Context(context.Background(), db))
+		ctx = auth.InternalWebhookAuth(ctx, &auth.AuthContext{
+			UserID:   42,
+			Username: "jdoe",
+		}, "meta.sr.ht", "test")
+
+		mock.ExpectBegin()
+		expectColumns(mock, "gql_profile_wh_sub", "secret")
+		mock.ExpectQuery(`SELECT .* FROM gql_profile_wh_sub sub`).
+			WithArgs(42, "PROFILE_UPDATE").
+			WillReturnRows(sqlmock.NewRows([]string{
+				"sub.id", "sub.user_id", "sub.url", "sub.query", "sub.auth_method",
+				"sub.token_hash", "sub.grants", "sub.client_id", "sub.expires",
+				"sub.node_id", "sub.secret",
+			}).AddRow(1337, 42, "https://example.org/webhook",
+				"query { me { username } }", auth.AUTH_INTERNAL,
+				nil, nil, "meta.sr.ht", nil, "test", nil))
+		mock.ExpectCommit()
+
+		queue := NewQueue(&schema, testConfig, "test")
+		if snapshots {
+			queue = queue.WithSnapshots()
+		}
+		q := sq.
+			Select().
+			From("gql_profile_wh_sub sub").
+			Where(`sub.user_id = ?`, 42)
+		payload := &profile{Username: "jdoe"}
+		err = queue.schedule(ctx, q, "profile", "PROFILE_UPDATE",
+			uuid.New(), payload)
+		assert.Nil(t, err)
+
+		// The data changes before the worker gets to the webhook
+		payload.Username = "alice"
+
+		expected := `{"data":{"me":{"username":"alice"}}}`
+		if snapshots {
+			expected = `{"data":{"me":{"username":"jdoe"}}}`
+		}
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO gql_profile_wh_delivery`).
+			WithArgs(sqlmock.AnyArg(), "PROFILE_UPDATE", 1337, expected).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(4096))
+		mock.ExpectCommit()
+		queue.Queue.Dispatch(ctx)
+		assert.Nil(t, mock.ExpectationsWereMet())
+	}
+}
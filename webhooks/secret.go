@@ -0,0 +1,63 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+
+	"git.sr.ht/~sircmpwn/core-go/crypto"
+)
+
+// In addition to the ed25519 X-Payload-Signature, subscriptions may be
+// configured with a shared secret, for receivers which only support HMAC
+// signatures. This requires the following nullable column on the subscription
+// table, which stores the secret encrypted with the network key, and is added
+// by MigrateSubscriptions and MigrateLegacySubscriptions:
+//
+//	secret bytea
+//
+// Deliveries to subscriptions with a secret include an X-Hub-Signature-256
+// header, which is "sha256=" followed by the hex-encoded HMAC-SHA256 of the
+// request body, keyed with the secret.
+const secretHeader = "X-Hub-Signature-256"
+
+// Generates a new webhook secret. Returns the secret, which should be shown to
+// the user so that they may configure their receiver, and the encrypted
+// secret, which should be stored in the subscription's secret column.
+func NewSecret() (string, []byte) {
+	var seed [32]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		panic(fmt.Errorf("Failed to generate webhook secret: %w", err))
+	}
+	secret := hex.EncodeToString(seed[:])
+	return secret, crypto.Encrypt([]byte(secret))
+}
+
+// Decrypts a webhook secret created with NewSecret, e.g. to show it to the
+// user again.
+func DecryptSecret(encrypted []byte) (string, error) {
+	secret := crypto.DecryptWithoutExpiration(encrypted)
+	if secret == nil {
+		return "", fmt.Errorf("Invalid webhook secret")
+	}
+	return string(secret), nil
+}
+
+// Adds the HMAC signature header for a payload to a request, if the
+// subscription has a secret.
+func signWithSecret(header http.Header, encrypted []byte, payload []byte) error {
+	if encrypted == nil {
+		return nil
+	}
+	secret, err := DecryptSecret(encrypted)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	header.Set(secretHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	return nil
+}
@@ -0,0 +1,37 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecret(t *testing.T) {
+	secret, encrypted := NewSecret()
+	assert.Len(t, secret, 64)
+	assert.NotContains(t, string(encrypted), secret)
+
+	decrypted, err := DecryptSecret(encrypted)
+	assert.Nil(t, err)
+	assert.Equal(t, secret, decrypted)
+
+	_, err = DecryptSecret([]byte("garbage"))
+	assert.NotNil(t, err)
+
+	payload := []byte(`{"hello": "world"}`)
+	header := make(http.Header)
+	assert.Nil(t, signWithSecret(header, encrypted, payload))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)),
+		header.Get("X-Hub-Signature-256"))
+
+	// Subscriptions without a secret are not signed
+	header = make(http.Header)
+	assert.Nil(t, signWithSecret(header, nil, payload))
+	assert.Equal(t, "", header.Get("X-Hub-Signature-256"))
+}